@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== API Tokens ==============
+
+// Scopes that can be granted to API tokens. Each route group requires one
+// scope for reads and one for writes (see routeGroup).
+const (
+	ScopeFilesRead  = "files:read"
+	ScopeFilesWrite = "files:write"
+	ScopeMgmtRead   = "mgmt:read"
+	ScopeMgmtUpdate = "mgmt:update"
+	ScopeTerminal   = "terminal"
+	ScopeExec       = "exec"
+	ScopeProxy      = "proxy"
+	ScopeAccount    = "account"
+	ScopeAdmin      = "admin"
+)
+
+var allScopes = []string{
+	ScopeFilesRead, ScopeFilesWrite, ScopeMgmtRead, ScopeMgmtUpdate,
+	ScopeTerminal, ScopeExec, ScopeProxy, ScopeAccount, ScopeAdmin,
+}
+
+// apiTokenPrefix marks Bearer values that are API tokens rather than the shared PORTAL_TOKEN.
+const apiTokenPrefix = "pt_"
+
+// APIToken is a named, scoped credential for automation. Only the SHA-256
+// hash of the secret is stored. The token acts with its owner's role,
+// narrowed to its scopes.
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	Scopes     []string   `json:"scopes"`
+	Hash       string     `json:"hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+}
+
+type APITokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*APIToken // by ID
+	dirty  bool
+}
+
+var apiTokens *APITokenStore
+
+func loadAPITokenStore(path string) (*APITokenStore, error) {
+	s := &APITokenStore{path: path, tokens: make(map[string]*APIToken)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var list []*APIToken
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, t := range list {
+			s.tokens[t.ID] = t
+		}
+	}
+	go func() {
+		// last-used updates are only flushed periodically
+		for range time.Tick(time.Minute) {
+			s.mu.Lock()
+			if s.dirty {
+				s.save()
+			}
+			s.mu.Unlock()
+		}
+	}()
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *APITokenStore) save() error {
+	list := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	if err := writeJSONFile(s.path, list); err != nil {
+		log.Printf("Failed to save API tokens: %v", err)
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func validScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, sc := range scopes {
+		if !hasScope(allScopes, sc) {
+			return errors.New("unknown scope: " + sc)
+		}
+	}
+	return nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, sc := range scopes {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Create mints a token and returns it together with its plaintext secret,
+// which is not retrievable later.
+func (s *APITokenStore) Create(owner, name string, scopes []string, expiresAt *time.Time) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+	if err := validScopes(scopes); err != nil {
+		return nil, "", err
+	}
+	id := generateToken()[:12]
+	secret := apiTokenPrefix + id + "_" + generateToken() + generateToken()
+	t := &APIToken{
+		ID:        id,
+		Name:      name,
+		Owner:     owner,
+		Scopes:    scopes,
+		Hash:      sessionID(secret),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[id] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, id)
+		return nil, "", err
+	}
+	copied := *t
+	return &copied, secret, nil
+}
+
+// Lookup finds the token for a Bearer secret and records its use.
+func (s *APITokenStore) Lookup(secret, ip string) (*APIToken, bool) {
+	rest := strings.TrimPrefix(secret, apiTokenPrefix)
+	i := strings.Index(rest, "_")
+	if i < 0 {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[rest[:i]]
+	if !ok || !secureEqual(t.Hash, sessionID(secret)) {
+		return nil, false
+	}
+	now := time.Now().UTC()
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return nil, false
+	}
+	t.LastUsedAt = &now
+	t.LastUsedIP = ip
+	s.dirty = true
+	copied := *t
+	return &copied, true
+}
+
+func (s *APITokenStore) Get(id string) (*APIToken, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *t
+	return &copied, true
+}
+
+// List returns the tokens owned by owner, or all tokens if owner is empty.
+func (s *APITokenStore) List(owner string) []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		if owner == "" || t.Owner == owner {
+			list = append(list, *t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Update renames a token and/or replaces its scopes.
+func (s *APITokenStore) Update(id, name string, scopes []string) (*APIToken, error) {
+	if scopes != nil {
+		if err := validScopes(scopes); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return nil, errors.New("token not found")
+	}
+	if name = strings.TrimSpace(name); name != "" {
+		t.Name = name
+	}
+	if scopes != nil {
+		t.Scopes = scopes
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (s *APITokenStore) Revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[id]; !ok {
+		return false
+	}
+	delete(s.tokens, id)
+	s.save()
+	return true
+}
+
+// RevokeOwner removes every token owned by owner and returns how many there
+// were.
+func (s *APITokenStore) RevokeOwner(owner string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, t := range s.tokens {
+		if t.Owner == owner {
+			delete(s.tokens, id)
+			s.dirty = true
+			n++
+		}
+	}
+	if s.dirty {
+		s.save()
+	}
+	return n
+}
+
+// ============== API Tokens API ==============
+
+func handleTokensAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p := principalFrom(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/tokens"), "/")
+
+	owner := p.Username
+	if p.Role == RoleAdmin {
+		owner = ""
+	}
+
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn string   `json:"expires_in"` // e.g. "720h"; empty means never
+	}
+
+	switch {
+	case r.Method == "GET" && id == "":
+		json.NewEncoder(w).Encode(map[string]interface{}{"tokens": publicTokens(apiTokens.List(owner))})
+
+	case r.Method == "POST" && id == "":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if isExternalUser(p.Username) {
+			http.Error(w, "API tokens require a local account", http.StatusForbidden)
+			return
+		}
+		if sc := scopeEscalation(p, req.Scopes); sc != "" {
+			http.Error(w, "Cannot grant scope "+sc, http.StatusForbidden)
+			return
+		}
+		var expiresAt *time.Time
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid expires_in", http.StatusBadRequest)
+				return
+			}
+			t := time.Now().UTC().Add(d)
+			expiresAt = &t
+		}
+		t, secret, err := apiTokens.Create(p.Username, req.Name, req.Scopes, expiresAt)
+		audit(r, "tokens.create", req.Name+" ["+strings.Join(req.Scopes, ",")+"]", err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out := publicTokens([]APIToken{*t})[0]
+		out["token"] = secret
+		json.NewEncoder(w).Encode(out)
+
+	case (r.Method == "PUT" || r.Method == "DELETE") && id != "":
+		t, ok := apiTokens.Get(id)
+		if !ok || (owner != "" && t.Owner != owner) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			apiTokens.Revoke(id)
+			audit(r, "tokens.revoke", t.Name+" ("+id+")", nil)
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if sc := scopeEscalation(p, req.Scopes); sc != "" {
+			http.Error(w, "Cannot grant scope "+sc, http.StatusForbidden)
+			return
+		}
+		t, err := apiTokens.Update(id, req.Name, req.Scopes)
+		audit(r, "tokens.update", id, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(publicTokens([]APIToken{*t})[0])
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// scopeEscalation returns the first requested scope that a token-authenticated
+// caller does not hold itself, so tokens cannot mint broader tokens.
+func scopeEscalation(p *Principal, requested []string) string {
+	if p.Scopes == nil {
+		return ""
+	}
+	for _, sc := range requested {
+		if !hasScope(p.Scopes, sc) {
+			return sc
+		}
+	}
+	return ""
+}
+
+// publicTokens strips secret hashes before tokens are sent to clients.
+func publicTokens(list []APIToken) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(list))
+	for _, t := range list {
+		m := map[string]interface{}{
+			"id":         t.ID,
+			"name":       t.Name,
+			"owner":      t.Owner,
+			"scopes":     t.Scopes,
+			"created_at": t.CreatedAt.Format(time.RFC3339),
+		}
+		if t.ExpiresAt != nil {
+			m["expires_at"] = t.ExpiresAt.Format(time.RFC3339)
+		}
+		if t.LastUsedAt != nil {
+			m["last_used_at"] = t.LastUsedAt.Format(time.RFC3339)
+			m["last_used_ip"] = t.LastUsedIP
+		}
+		out = append(out, m)
+	}
+	return out
+}
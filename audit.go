@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== Audit Log ==============
+
+// AuditEvent is one line of the audit log.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	IP     string    `json:"ip"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Result string    `json:"result"`
+}
+
+// AuditLog appends events as JSON lines and rotates the file once it grows
+// past maxSize, keeping maxFiles old files (path.1 is the newest).
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+var auditLog *AuditLog
+
+func openAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// rotate must be called with a.mu held.
+func (a *AuditLog) rotate() error {
+	a.f.Close()
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.maxFiles > 0 {
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	return a.open()
+}
+
+func (a *AuditLog) Write(ev AuditEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxSize > 0 && a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			log.Printf("Audit log rotation failed: %v", err)
+			return
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Audit log write failed: %v", err)
+	}
+}
+
+// files returns the log files from oldest to newest.
+func (a *AuditLog) files() []string {
+	var list []string
+	for i := a.maxFiles; i >= 1; i-- {
+		p := fmt.Sprintf("%s.%d", a.path, i)
+		if _, err := os.Stat(p); err == nil {
+			list = append(list, p)
+		}
+	}
+	return append(list, a.path)
+}
+
+// Query returns matching events, newest first, at most limit of them. Files
+// are read from the newest back, so older files are only opened while fewer
+// than limit events have been found.
+func (a *AuditLog) Query(match func(*AuditEvent) bool, limit int) []AuditEvent {
+	a.mu.Lock()
+	files := a.files()
+	a.mu.Unlock()
+
+	var events []AuditEvent
+	for k := len(files) - 1; k >= 0; k-- {
+		f, err := os.Open(files[k])
+		if err != nil {
+			continue
+		}
+		var found []AuditEvent
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var ev AuditEvent
+			if json.Unmarshal(scanner.Bytes(), &ev) == nil && match(&ev) {
+				found = append(found, ev)
+			}
+		}
+		f.Close()
+		// 文件内按时间顺序写入，最新的在前
+		for i := len(found) - 1; i >= 0; i-- {
+			events = append(events, found[i])
+		}
+		if limit > 0 && len(events) >= limit {
+			return events[:limit]
+		}
+	}
+	return events
+}
+
+// audit records a privileged action performed by the caller of r.
+func audit(r *http.Request, action, target string, err error) {
+	actor := "-"
+	if p := principalFrom(r); p != nil {
+		actor = p.Username
+		if p.TokenID != "" {
+			actor += " (api token " + p.TokenID + ")"
+		}
+	}
+	auditAs(r, actor, action, target, err)
+}
+
+// auditAs records an event for an explicitly named actor, e.g. a login attempt.
+func auditAs(r *http.Request, actor, action, target string, err error) {
+	if auditLog == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+	auditLog.Write(AuditEvent{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		IP:     clientIP(r),
+		Action: action,
+		Target: target,
+		Result: result,
+	})
+}
+
+// ============== Audit API ==============
+
+// handleAuditAPI queries the audit log. Filters: actor (exact), action
+// (prefix, e.g. "files."), since/until (RFC 3339) and limit.
+func handleAuditAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+
+	var since, until time.Time
+	var err error
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid until", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 200
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	actor, action := q.Get("actor"), q.Get("action")
+
+	events := auditLog.Query(func(ev *AuditEvent) bool {
+		if actor != "" && ev.Actor != actor && !strings.HasPrefix(ev.Actor, actor+" (") {
+			return false
+		}
+		if action != "" && !strings.HasPrefix(ev.Action, action) {
+			return false
+		}
+		if !since.IsZero() && ev.Time.Before(since) {
+			return false
+		}
+		if !until.IsZero() && ev.Time.After(until) {
+			return false
+		}
+		return true
+	}, limit)
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"events": events})
+}
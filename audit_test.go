@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuditQueryNewestFirst(t *testing.T) {
+	a, err := openAuditLog(filepath.Join(t.TempDir(), "portal-audit.log"), 300, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		a.Write(AuditEvent{Time: start.Add(time.Duration(i) * time.Minute), Actor: "alice", Action: "files.write", Target: strconv.Itoa(i), Result: "ok"})
+	}
+	if len(a.files()) < 4 {
+		t.Fatalf("log was not rotated: %v", a.files())
+	}
+
+	decoded := 0
+	events := a.Query(func(ev *AuditEvent) bool {
+		decoded++
+		return true
+	}, 3)
+	var got []string
+	for _, ev := range events {
+		got = append(got, ev.Target)
+	}
+	if len(got) != 3 || got[0] != "19" || got[1] != "18" || got[2] != "17" {
+		t.Errorf("Query = %v, want [19 18 17]", got)
+	}
+	// 找够之后不再读取更早的文件
+	if decoded >= 20 {
+		t.Errorf("decoded %d events for limit 3", decoded)
+	}
+
+	all := a.Query(func(ev *AuditEvent) bool { return true }, 0)
+	if len(all) != 20 || all[0].Target != "19" || all[19].Target != "0" {
+		t.Errorf("unlimited Query returned %d events", len(all))
+	}
+}
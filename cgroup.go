@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============== Resource Limits (cgroup v2) ==============
+
+// cgroupLimits are applied to the cgroup of every terminal and exec process.
+// Zero means no limit.
+type cgroupLimits struct {
+	MemoryMax int64   // bytes
+	CPUMax    float64 // CPUs, e.g. 0.5
+	PidsMax   int64
+}
+
+// loadCgroupLimits reads PORTAL_CGROUP_MEMORY_MAX ("512M"),
+// PORTAL_CGROUP_CPU_MAX ("0.5") and PORTAL_CGROUP_PIDS_MAX ("256").
+func loadCgroupLimits() (cgroupLimits, error) {
+	var l cgroupLimits
+	var err error
+	if v := os.Getenv("PORTAL_CGROUP_MEMORY_MAX"); v != "" {
+		if l.MemoryMax, err = parseByteSize(v); err != nil || l.MemoryMax <= 0 {
+			return l, fmt.Errorf("invalid PORTAL_CGROUP_MEMORY_MAX: %q", v)
+		}
+	}
+	if v := os.Getenv("PORTAL_CGROUP_CPU_MAX"); v != "" {
+		if l.CPUMax, err = strconv.ParseFloat(v, 64); err != nil || l.CPUMax <= 0 {
+			return l, fmt.Errorf("invalid PORTAL_CGROUP_CPU_MAX: %q", v)
+		}
+	}
+	if v := os.Getenv("PORTAL_CGROUP_PIDS_MAX"); v != "" {
+		if l.PidsMax, err = strconv.ParseInt(v, 10, 64); err != nil || l.PidsMax <= 0 {
+			return l, fmt.Errorf("invalid PORTAL_CGROUP_PIDS_MAX: %q", v)
+		}
+	}
+	return l, nil
+}
+
+func (l cgroupLimits) any() bool {
+	return l.MemoryMax > 0 || l.CPUMax > 0 || l.PidsMax > 0
+}
+
+// parseByteSize parses sizes like "512M" or "1G" (powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n << shift, nil
+}
+
+// CgroupManager creates one child cgroup per spawned process under a
+// delegated parent cgroup.
+type CgroupManager struct {
+	parent string
+	limits cgroupLimits
+}
+
+var cgroups *CgroupManager // nil: limits are not in use
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// setupCgroups prepares parent (by default the portal's own cgroup) for
+// per-process child cgroups. The portal can only do this when it runs on a
+// cgroup v2 host with the controllers delegated to it, e.g. as a systemd
+// service with Delegate=yes.
+func setupCgroups(parent string, limits cgroupLimits) (*CgroupManager, error) {
+	if !cgroupFDSupported {
+		return nil, errors.New("cgroups are only supported on Linux")
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	if parent == "" {
+		parent = own
+	}
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 directory", parent)
+	}
+
+	var want []string
+	if limits.MemoryMax > 0 {
+		want = append(want, "memory")
+	}
+	if limits.CPUMax > 0 {
+		want = append(want, "cpu")
+	}
+	if limits.PidsMax > 0 {
+		want = append(want, "pids")
+	}
+	available, _ := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	for _, c := range want {
+		if !containsWord(string(available), c) {
+			return nil, fmt.Errorf("the %s controller is not delegated to %s", c, parent)
+		}
+	}
+
+	// 有进程的 cgroup 不能给子 cgroup 启用控制器 (no internal processes)，
+	// 所以先把 portal 自身 (以及同组的 Shelley 等) 移到叶子 cgroup "portal"。
+	// 真正的根 cgroup 没有 cgroup.type，也不受此限制
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.type")); parent == own && err == nil {
+		leaf := filepath.Join(parent, "portal")
+		if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		procs, _ := os.ReadFile(filepath.Join(parent, "cgroup.procs"))
+		for _, pid := range strings.Fields(string(procs)) {
+			// 进程可能已经退出，忽略单个失败
+			os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+		}
+	}
+	enable := ""
+	for _, c := range want {
+		enable += " +" + c
+	}
+	if enable != "" {
+		if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.TrimSpace(enable)), 0644); err != nil {
+			return nil, fmt.Errorf("enable controllers in %s: %v", parent, err)
+		}
+	}
+
+	m := &CgroupManager{parent: parent, limits: limits}
+	// 清理上次异常退出留下的空 cgroup
+	stale, _ := filepath.Glob(filepath.Join(parent, "portal-*"))
+	for _, dir := range stale {
+		os.Remove(dir)
+	}
+	if err := m.probe(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ownCgroup returns the directory of the portal's cgroup v2 group.
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(cgroupRoot, path), nil
+		}
+	}
+	return "", errors.New("cgroup v2 is not in use")
+}
+
+func containsWord(s, word string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == word {
+			return true
+		}
+	}
+	return false
+}
+
+// probe starts a process in a test cgroup, so that a kernel without
+// CLONE_INTO_CGROUP (Linux < 5.7) is detected at startup.
+func (m *CgroupManager) probe() error {
+	cg, err := m.New("probe")
+	if err != nil {
+		return err
+	}
+	defer cg.Remove()
+	cmd := exec.Command("/bin/sh", "-c", ":")
+	if err := cg.Apply(cmd); err != nil {
+		return err
+	}
+	err = cmd.Run()
+	cg.Started()
+	if err != nil {
+		return fmt.Errorf("start a process in a cgroup: %v", err)
+	}
+	return nil
+}
+
+// New creates the cgroup for one process. It is safe to call on a nil
+// manager, which returns a nil cgroup.
+func (m *CgroupManager) New(name string) (*procCgroup, error) {
+	if m == nil {
+		return nil, nil
+	}
+	g := &procCgroup{dir: filepath.Join(m.parent, "portal-"+name)}
+	if err := os.Mkdir(g.dir, 0755); err != nil {
+		return nil, err
+	}
+	var settings [][2]string
+	if m.limits.MemoryMax > 0 {
+		settings = append(settings,
+			[2]string{"memory.max", strconv.FormatInt(m.limits.MemoryMax, 10)},
+			// OOM 时结束整个会话，而不是留下半个进程树
+			[2]string{"memory.oom.group", "1"})
+	}
+	if m.limits.CPUMax > 0 {
+		const period = 100000
+		settings = append(settings, [2]string{"cpu.max", fmt.Sprintf("%d %d", int64(m.limits.CPUMax*period), period)})
+	}
+	if m.limits.PidsMax > 0 {
+		settings = append(settings, [2]string{"pids.max", strconv.FormatInt(m.limits.PidsMax, 10)})
+	}
+	for _, s := range settings {
+		if err := os.WriteFile(filepath.Join(g.dir, s[0]), []byte(s[1]), 0644); err != nil {
+			os.Remove(g.dir)
+			return nil, fmt.Errorf("set %s: %v", s[0], err)
+		}
+	}
+	return g, nil
+}
+
+// procCgroup is the cgroup of one terminal or exec process. All methods are
+// no-ops on a nil cgroup.
+type procCgroup struct {
+	dir string
+	f   *os.File // held open from Apply until Started
+}
+
+// Apply makes cmd start inside the cgroup. Call Started after cmd.Start.
+func (g *procCgroup) Apply(cmd *exec.Cmd) error {
+	if g == nil {
+		return nil
+	}
+	f, err := os.Open(g.dir)
+	if err != nil {
+		return err
+	}
+	g.f = f
+	setCgroupFD(cmd, int(f.Fd()))
+	return nil
+}
+
+// Started releases the descriptor held for cmd.Start.
+func (g *procCgroup) Started() {
+	if g == nil || g.f == nil {
+		return
+	}
+	g.f.Close()
+	g.f = nil
+}
+
+// Kill ends every process left in the cgroup, including background jobs
+// that escaped the process group.
+func (g *procCgroup) Kill() {
+	if g == nil {
+		return
+	}
+	// cgroup.kill 需要 Linux 5.14+，否则逐个结束
+	if os.WriteFile(filepath.Join(g.dir, "cgroup.kill"), []byte("1"), 0644) == nil {
+		return
+	}
+	procs, _ := os.ReadFile(filepath.Join(g.dir, "cgroup.procs"))
+	for _, pid := range strings.Fields(string(procs)) {
+		if n, err := strconv.Atoi(pid); err == nil {
+			syscall.Kill(n, syscall.SIGKILL)
+		}
+	}
+}
+
+// Remove kills what is left in the cgroup and deletes it once empty.
+func (g *procCgroup) Remove() {
+	if g == nil {
+		return
+	}
+	g.Started()
+	g.Kill()
+	go func() {
+		// 进程被结束后需要一点时间才会离开 cgroup
+		for i := 0; i < 50; i++ {
+			if err := os.Remove(g.dir); err == nil || os.IsNotExist(err) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		log.Printf("Failed to remove cgroup %s", g.dir)
+	}()
+}
+
+// CgroupUsage is the resource usage of a terminal or exec process tree.
+type CgroupUsage struct {
+	MemoryCurrent int64   `json:"memory_current"`
+	MemoryPeak    int64   `json:"memory_peak,omitempty"` // Linux 5.19+
+	MemoryMax     int64   `json:"memory_max,omitempty"`  // 0: unlimited
+	OOMKills      int64   `json:"oom_kills,omitempty"`
+	CPUUsec       int64   `json:"cpu_usec"`
+	CPUMax        float64 `json:"cpu_max,omitempty"`
+	Pids          int64   `json:"pids"`
+	PidsMax       int64   `json:"pids_max,omitempty"`
+}
+
+// Usage reads the cgroup's counters. It returns nil for a nil cgroup.
+func (g *procCgroup) Usage() *CgroupUsage {
+	if g == nil {
+		return nil
+	}
+	u := &CgroupUsage{
+		MemoryCurrent: g.readInt("memory.current"),
+		MemoryPeak:    g.readInt("memory.peak"),
+		MemoryMax:     g.readInt("memory.max"),
+		OOMKills:      g.readKey("memory.events", "oom_kill"),
+		CPUUsec:       g.readKey("cpu.stat", "usage_usec"),
+		Pids:          g.readInt("pids.current"),
+		PidsMax:       g.readInt("pids.max"),
+	}
+	if quota, period, ok := strings.Cut(g.read("cpu.max"), " "); ok {
+		q, _ := strconv.ParseFloat(quota, 64)
+		p, _ := strconv.ParseFloat(period, 64)
+		if p > 0 {
+			u.CPUMax = q / p
+		}
+	}
+	return u
+}
+
+func (g *procCgroup) read(file string) string {
+	data, _ := os.ReadFile(filepath.Join(g.dir, file))
+	return strings.TrimSpace(string(data))
+}
+
+// readInt reads a single-value file; "max" and missing files read as 0.
+func (g *procCgroup) readInt(file string) int64 {
+	n, _ := strconv.ParseInt(g.read(file), 10, 64)
+	return n
+}
+
+// readKey reads one entry of a flat keyed file like cpu.stat.
+func (g *procCgroup) readKey(file, key string) int64 {
+	f, err := os.Open(filepath.Join(g.dir, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), key+" "); ok {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
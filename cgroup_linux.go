@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const cgroupFDSupported = true
+
+// setCgroupFD makes cmd start directly inside the cgroup open at fd
+// (CLONE_INTO_CGROUP), so no child escapes before it is moved.
+func setCgroupFD(cmd *exec.Cmd, fd int) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+const cgroupFDSupported = false
+
+func setCgroupFD(cmd *exec.Cmd, fd int) {}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ============== Command Execution API ==============
+
+var (
+	execDefaultTimeout = 10 * time.Minute
+	execMaxTimeout     = time.Hour
+)
+
+type execRequest struct {
+	Argv    []string          `json:"argv"`    // run directly
+	Command string            `json:"command"` // or run with /bin/sh -c
+	Cwd     string            `json:"cwd"`
+	Env     map[string]string `json:"env"`
+	Timeout string            `json:"timeout"` // e.g. "30s"
+	Stdin   *string           `json:"stdin"`
+}
+
+// execEvent is one line of the NDJSON stream (or one SSE event).
+type execEvent struct {
+	Type       string       `json:"type"` // start, stdout, stderr, exit
+	Data       string       `json:"data,omitempty"`
+	PID        int          `json:"pid,omitempty"`
+	Code       *int         `json:"code,omitempty"`
+	TimedOut   bool         `json:"timed_out,omitempty"`
+	DurationMs int64        `json:"duration_ms,omitempty"`
+	Resources  *CgroupUsage `json:"resources,omitempty"` // with the exit event
+	Error      string       `json:"error,omitempty"`
+}
+
+// execStream writes events as NDJSON or as Server-Sent Events.
+type execStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+}
+
+func (s *execStream) send(ev execEvent) {
+	data, _ := json.Marshal(ev)
+	if s.sse {
+		fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", ev.Type, data)
+	} else {
+		s.w.Write(append(data, '\n'))
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// execOutput turns the command's stdout or stderr into events. Writes are cut
+// at UTF-8 character boundaries because events carry JSON strings.
+type execOutput struct {
+	kind    string
+	events  chan<- execEvent
+	pending []byte
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	var text []byte
+	text, o.pending = splitUTF8(append(o.pending, p...))
+	if len(text) > 0 {
+		o.events <- execEvent{Type: o.kind, Data: string(text)}
+	}
+	return len(p), nil
+}
+
+// flush sends what is left of an incomplete character at the end.
+func (o *execOutput) flush() {
+	if len(o.pending) > 0 {
+		o.events <- execEvent{Type: o.kind, Data: string(o.pending)}
+		o.pending = nil
+	}
+}
+
+// handleExecAPI runs a command without a PTY and streams its output:
+//
+//	POST /portal/api/exec {"argv": ["git", "pull"], "cwd": "...", "env": {...}, "timeout": "5m", "stdin": "..."}
+//	POST /portal/api/exec {"command": "git pull && make"}
+//
+// The response is NDJSON, or SSE with Accept: text/event-stream or
+// ?format=sse. The command runs in its own process group, which is killed
+// on timeout, when the client disconnects, and after the command exits so
+// that background children do not outlive it.
+func handleExecAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req execRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	argv := req.Argv
+	if req.Command != "" {
+		if len(argv) > 0 {
+			http.Error(w, "Use either argv or command", http.StatusBadRequest)
+			return
+		}
+		argv = []string{"/bin/sh", "-c", req.Command}
+	}
+	if len(argv) == 0 {
+		http.Error(w, "argv or command is required", http.StatusBadRequest)
+		return
+	}
+	timeout := execDefaultTimeout
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	if timeout > execMaxTimeout {
+		timeout = execMaxTimeout
+	}
+	cwd := req.Cwd
+	if cwd == "" {
+		cwd = baseDir
+	}
+	if info, err := os.Stat(cwd); err != nil || !info.IsDir() {
+		http.Error(w, "Invalid cwd", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = cwd
+	cmd.Env = os.Environ()
+	for k, v := range req.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			http.Error(w, "Invalid env name "+k, http.StatusBadRequest)
+			return
+		}
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	if req.Stdin != nil {
+		cmd.Stdin = strings.NewReader(*req.Stdin)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cg, err := cgroups.New("exec-" + generateToken())
+	if err == nil {
+		err = cg.Apply(cmd)
+	}
+	if err != nil {
+		log.Printf("Failed to create cgroup for exec: %v", err)
+		cg.Remove()
+		cg = nil
+	}
+	defer cg.Remove()
+	cmd.Cancel = func() error {
+		cg.Kill()
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// 命令退出 (或超时) 后，后台子进程可能继续占用管道，最多再等 5 秒
+	cmd.WaitDelay = 5 * time.Second
+	// 两路输出汇总到一个 channel，由当前 goroutine 统一写响应
+	events := make(chan execEvent, 64)
+	stdout := &execOutput{kind: "stdout", events: events}
+	stderr := &execOutput{kind: "stderr", events: events}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	cmdline := strings.Join(argv, " ")
+	err = cmd.Start()
+	cg.Started()
+	if err != nil {
+		audit(r, "exec.run", cmdline, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit(r, "exec.run", cmdline, nil)
+	started := time.Now()
+
+	stream := &execStream{w: w, sse: r.URL.Query().Get("format") == "sse" ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")}
+	stream.flusher, _ = w.(http.Flusher)
+	if stream.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	stream.send(execEvent{Type: "start", PID: cmd.Process.Pid})
+
+	go func() {
+		err = cmd.Wait()
+		stdout.flush()
+		stderr.flush()
+		close(events)
+	}()
+	for ev := range events {
+		stream.send(ev)
+	}
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	exit := execEvent{Type: "exit", DurationMs: time.Since(started).Milliseconds(), Resources: cg.Usage()}
+	code := cmd.ProcessState.ExitCode()
+	exit.Code = &code
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		exit.TimedOut = true
+		exit.Error = "timed out after " + timeout.String()
+	} else if err != nil && !errors.As(err, new(*exec.ExitError)) && !errors.Is(err, exec.ErrWaitDelay) {
+		exit.Error = err.Error()
+	}
+	if r.Context().Err() != nil {
+		audit(r, "exec.exit", cmdline, errors.New("client disconnected, process group killed"))
+		return
+	}
+	var result error
+	if exit.Error != "" {
+		result = errors.New(exit.Error)
+	} else if code != 0 {
+		result = fmt.Errorf("exit code %d", code)
+	}
+	audit(r, "exec.exit", cmdline, result)
+	stream.send(exit)
+}
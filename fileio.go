@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ============== File Writes ==============
+
+// fileWriteMu serializes If-Match checks with the writes they guard.
+var fileWriteMu sync.Mutex
+
+// fileETag returns a strong ETag for file content. A content hash rather than
+// mtime+size, because the agent and an editor can both save within the same
+// mtime tick.
+func fileETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch reports whether an If-Match / If-None-Match header matches etag.
+// Weak tags never match, as If-Match requires strong comparison.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// statETag returns a strong ETag for downloads from a file's size and mtime.
+// Hashing would mean reading the whole file before sending the first byte
+// of a range; the editor API uses fileETag instead.
+func statETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// writeFileAtomic replaces path with the contents of r through a temporary
+// file in the same directory, so readers never see a half-written file. An
+// existing file keeps its mode and, where permitted, its owner; a symlink is
+// followed and its target replaced.
+func writeFileAtomic(path string, r io.Reader) error {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	mode := os.FileMode(0644)
+	info, err := os.Stat(path)
+	if err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // 成功 rename 后不存在
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if info != nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			// 以 root 运行时保持原文件属主，否则忽略失败
+			tmp.Chown(int(st.Uid), int(st.Gid))
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
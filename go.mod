@@ -3,6 +3,6 @@ module portal
 go 1.22.2
 
 require (
-	github.com/creack/pty v1.1.24 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/creack/pty v1.1.24
+	github.com/gorilla/websocket v1.5.3
 )
@@ -131,7 +131,7 @@ download_portal() {
     
     log_info "编译 Portal..."
     cd "$tmp_dir/openshelleyv2-main"
-    go build -o "$INSTALL_DIR/portal" main.go
+    go build -o "$INSTALL_DIR/portal" .
     
     # 复制需要的文件
     cp -r static "$INSTALL_DIR/"
@@ -292,6 +292,8 @@ User=$user
 WorkingDirectory=$INSTALL_DIR
 EnvironmentFile=$INSTALL_DIR/.env
 ExecStart=$INSTALL_DIR/portal
+# 允许 Portal 为终端和命令创建子 cgroup (资源限制)
+Delegate=yes
 Restart=always
 RestartSec=5
 
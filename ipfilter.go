@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ============== IP Allow/Deny Lists ==============
+
+// IPFilter admits a client address if it is not denied and, when an allow
+// list is set, allowed. Deny entries win over allow entries.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+var (
+	globalIPFilter *IPFilter            // applied to every request, before auth
+	groupIPFilters map[string]*IPFilter // by route group name
+)
+
+// loadIPFilter reads PREFIX_ALLOW_CIDRS and PREFIX_DENY_CIDRS. It returns nil
+// when neither is set.
+func loadIPFilter(prefix string) (*IPFilter, error) {
+	allow, err := parseCIDRList(os.Getenv(prefix + "_ALLOW_CIDRS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_ALLOW_CIDRS: %v", prefix, err)
+	}
+	deny, err := parseCIDRList(os.Getenv(prefix + "_DENY_CIDRS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_DENY_CIDRS: %v", prefix, err)
+	}
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+	return &IPFilter{allow: allow, deny: deny}, nil
+}
+
+// loadIPFilters loads the global lists (PORTAL_ALLOW_CIDRS, PORTAL_DENY_CIDRS)
+// and one pair per route group, e.g. PORTAL_TERMINAL_ALLOW_CIDRS.
+func loadIPFilters() error {
+	var err error
+	if globalIPFilter, err = loadIPFilter("PORTAL"); err != nil {
+		return err
+	}
+	groupIPFilters = make(map[string]*IPFilter)
+	for _, g := range []routeGroup{groupFiles, groupMgmt, groupTerminal, groupExec, groupProxy, groupAdmin, groupAccount} {
+		f, err := loadIPFilter("PORTAL_" + strings.ToUpper(g.name))
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			groupIPFilters[g.name] = f
+		}
+	}
+	return nil
+}
+
+// Allows reports whether addr may connect. A nil filter allows everything.
+func (f *IPFilter) Allows(addr string) bool {
+	if f == nil {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return f.allow == nil
+	}
+	if ipInNets(ip, f.deny) {
+		return false
+	}
+	return f.allow == nil || ipInNets(ip, f.allow)
+}
+
+// ipFilterHandler rejects clients outside the global lists before any other
+// handler (including login) sees the request.
+func ipFilterHandler(f *IPFilter, next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.Allows(clientIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
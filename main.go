@@ -5,12 +5,15 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/rand"
+	"crypto/subtle"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -23,7 +26,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 )
 
@@ -69,6 +71,133 @@ func main() {
 		baseDir = filepath.Dir(exePath)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "rotate-token" {
+		if err := runRotateTokenCommand(os.Args[2:]); err != nil {
+			log.Fatalf("rotate-token: %v", err)
+		}
+		return
+	}
+
+	var err error
+	users, err = loadUserStore(dataPath("portal-users.json"))
+	if err != nil {
+		log.Fatalf("Failed to load users: %v", err)
+	}
+	sessions, err = loadSessionStore(dataPath("portal-sessions.json"),
+		envDuration("PORTAL_SESSION_IDLE_TIMEOUT", 7*24*time.Hour),
+		envDuration("PORTAL_SESSION_MAX_AGE", 30*24*time.Hour))
+	if err != nil {
+		log.Fatalf("Failed to load sessions: %v", err)
+	}
+	totp, err = loadTOTPStore(dataPath("portal-totp.json"))
+	if err != nil {
+		log.Fatalf("Failed to load TOTP settings: %v", err)
+	}
+	apiTokens, err = loadAPITokenStore(dataPath("portal-tokens.json"))
+	if err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+
+	trustedProxies, err = parseCIDRList(os.Getenv("PORTAL_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid PORTAL_TRUSTED_PROXIES: %v", err)
+	}
+	if err := loadIPFilters(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	configPath := os.Getenv("PORTAL_CONFIG")
+	if configPath == "" {
+		configPath = dataPath("portal-config.json")
+	}
+	portalConfig, err = loadPortalConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	// 默认的 workspace 根目录包含 .env 和 data/，不能通过文件 API 访问
+	protectPortalState(envFilePath(), dataPath(""), configPath)
+
+	cgroupLimits, err := loadCgroupLimits()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cgroupLimits.any() {
+		// 没有 cgroup v2 委派时照常运行，只是不做资源限制
+		if cgroups, err = setupCgroups(os.Getenv("PORTAL_CGROUP_PARENT"), cgroupLimits); err != nil {
+			log.Printf("Resource limits disabled: %v", err)
+		} else {
+			log.Printf("Resource limits enabled in %s", cgroups.parent)
+		}
+	}
+
+	// 终端内 portal-send / portal-recv 命令
+	if err := installTransferHelpers(dataPath("bin")); err != nil {
+		log.Printf("Failed to install terminal transfer helpers: %v", err)
+	}
+
+	terminals = newTermRegistry(
+		envDuration("PORTAL_TERMINAL_ORPHAN_TIMEOUT", 30*time.Minute),
+		envInt("PORTAL_TERMINAL_SCROLLBACK_KB", 256)<<10)
+	termPingInterval = envDuration("PORTAL_TERMINAL_PING_INTERVAL", termPingInterval)
+	idleAction := os.Getenv("PORTAL_TERMINAL_IDLE_ACTION")
+	if idleAction != "" && idleAction != "detach" && idleAction != "kill" {
+		log.Fatalf("Invalid PORTAL_TERMINAL_IDLE_ACTION %q (detach or kill)", idleAction)
+	}
+	terminals.StartIdleReaper(
+		envDuration("PORTAL_TERMINAL_IDLE_TIMEOUT", 0),
+		envDuration("PORTAL_TERMINAL_IDLE_WARNING", time.Minute),
+		idleAction == "kill")
+
+	recordingsDir := os.Getenv("PORTAL_RECORDINGS_DIR")
+	if recordingsDir == "" {
+		recordingsDir = dataPath("recordings")
+	}
+	recordAll, _ := strconv.ParseBool(os.Getenv("PORTAL_TERMINAL_RECORD"))
+	recordings, err = newRecordingStore(recordingsDir, recordAll,
+		envDuration("PORTAL_RECORDINGS_MAX_AGE", 30*24*time.Hour),
+		int64(envInt("PORTAL_RECORDINGS_MAX_SIZE_MB", 500))<<20)
+	if err != nil {
+		log.Fatalf("Failed to open recordings directory: %v", err)
+	}
+	uploads, err = newUploadStore(dataPath("uploads"), envDuration("PORTAL_UPLOAD_EXPIRY", 24*time.Hour))
+	if err != nil {
+		log.Fatalf("Failed to open uploads directory: %v", err)
+	}
+	trash = newTrashStore(
+		envDuration("PORTAL_TRASH_MAX_AGE", 30*24*time.Hour),
+		int64(envInt("PORTAL_TRASH_MAX_SIZE_MB", 1024))<<20)
+	execDefaultTimeout = envDuration("PORTAL_EXEC_TIMEOUT", execDefaultTimeout)
+	execMaxTimeout = envDuration("PORTAL_EXEC_MAX_TIMEOUT", execMaxTimeout)
+	authLimiter = newAuthLimiter(
+		envInt("PORTAL_LOGIN_MAX_FAILURES", 5),
+		envDuration("PORTAL_LOGIN_LOCKOUT", 30*time.Second),
+		envDuration("PORTAL_LOGIN_MAX_LOCKOUT", time.Hour),
+		envInt("PORTAL_LOGIN_GLOBAL_LIMIT", 100))
+
+	allowedOrigins = parseOriginList(os.Getenv("PORTAL_ALLOWED_ORIGINS"))
+
+	oidcConfig, err := loadOIDCConfig()
+	if err != nil {
+		log.Fatalf("Invalid OIDC configuration: %v", err)
+	}
+	if oidcConfig != nil {
+		oidc = newOIDCProvider(*oidcConfig)
+		log.Printf("OIDC login enabled (issuer %s)", oidcConfig.Issuer)
+	}
+
+	auditPath := os.Getenv("PORTAL_AUDIT_LOG")
+	if auditPath == "" {
+		auditPath = filepath.Join(baseDir, "logs", "portal-audit.log")
+	}
+	auditLog, err = openAuditLog(auditPath,
+		int64(envInt("PORTAL_AUDIT_MAX_SIZE_MB", 10))<<20,
+		envInt("PORTAL_AUDIT_MAX_FILES", 5))
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	// 默认位于 workspace 内，不能通过文件 API 读取、改写或删除
+	protectPortalState(auditPath)
+
 	log.Printf("Portal starting on port %s", portalPort)
 	log.Printf("Auth Token: %s", authToken)
 	log.Printf("Open Shelley URL: %s", shelleyURL)
@@ -77,6 +206,8 @@ func main() {
 
 	// Login page (no auth required)
 	mux.HandleFunc("/login", handleLogin)
+	mux.HandleFunc("/login/oidc", handleOIDCLogin)
+	mux.HandleFunc("/login/oidc/callback", handleOIDCCallback)
 	mux.HandleFunc("/logout", handleLogout)
 
 	// Portal static files
@@ -88,26 +219,65 @@ func main() {
 	mux.HandleFunc("/portal/files", authMiddleware(handleFilesPage))
 
 	// Portal API endpoints (require auth)
-	mux.HandleFunc("/portal/api/files/", authMiddleware(handleFilesAPI))
-	mux.HandleFunc("/portal/api/file/", authMiddleware(handleFileAPI))
-	mux.HandleFunc("/portal/api/upload/", authMiddleware(handleUpload))
-	mux.HandleFunc("/portal/api/download/", authMiddleware(handleDownload))
+	mux.HandleFunc("/portal/api/files/", protect(groupFiles, handleFilesAPI))
+	mux.HandleFunc("/portal/api/file/", protect(groupFiles, handleFileAPI))
+	mux.HandleFunc("/portal/api/upload/", protect(groupFiles, handleUpload))
+	mux.HandleFunc("/portal/api/uploads", protect(groupFiles, handleUploadsAPI))
+	mux.HandleFunc("/portal/api/uploads/", protect(groupFiles, handleUploadsAPI))
+	mux.HandleFunc("/portal/api/download/", protect(groupFiles, handleDownload))
+	mux.HandleFunc("/portal/api/roots", protect(groupFiles, handleFileRootsAPI))
+	mux.HandleFunc("/portal/api/trash", protect(groupFiles, handleTrashAPI))
+	mux.HandleFunc("/portal/api/trash/", protect(groupFiles, handleTrashAPI))
 
 	// Management API endpoints
-	mux.HandleFunc("/portal/api/mgmt/status", authMiddleware(handleMgmtStatus))
-	mux.HandleFunc("/portal/api/mgmt/token", authMiddleware(handleMgmtToken))
-	mux.HandleFunc("/portal/api/mgmt/check-update", authMiddleware(handleMgmtCheckUpdate))
-	mux.HandleFunc("/portal/api/mgmt/update", authMiddleware(handleMgmtUpdate))
-	mux.HandleFunc("/portal/api/mgmt/backups", authMiddleware(handleMgmtBackups))
-	mux.HandleFunc("/portal/api/mgmt/rollback", authMiddleware(handleMgmtRollback))
+	mux.HandleFunc("/portal/api/mgmt/status", protect(groupMgmt, handleMgmtStatus))
+	mux.HandleFunc("/portal/api/mgmt/token", protect(groupAdmin, handleMgmtToken))
+	mux.HandleFunc("/portal/api/mgmt/token/rotate", protect(groupAdmin, handleMgmtTokenRotate))
+	mux.HandleFunc("/portal/api/mgmt/check-update", protect(groupMgmt, handleMgmtCheckUpdate))
+	mux.HandleFunc("/portal/api/mgmt/update", protect(groupMgmt, handleMgmtUpdate))
+	mux.HandleFunc("/portal/api/mgmt/backups", protect(groupMgmt, handleMgmtBackups))
+	mux.HandleFunc("/portal/api/mgmt/rollback", protect(groupMgmt, handleMgmtRollback))
+
+	// User management (admin only)
+	mux.HandleFunc("/portal/api/users", protect(groupAdmin, handleUsersAPI))
+	mux.HandleFunc("/portal/api/users/", protect(groupAdmin, handleUsersAPI))
+
+	// Login sessions of the current user (all sessions for admins)
+	mux.HandleFunc("/portal/api/sessions", protect(groupAccount, handleSessionsAPI))
+	mux.HandleFunc("/portal/api/sessions/", protect(groupAccount, handleSessionsAPI))
+
+	// Two-factor enrollment for the current user
+	mux.HandleFunc("/portal/api/totp", protect(groupAccount, handleTOTPAPI))
+	mux.HandleFunc("/portal/api/totp/", protect(groupAccount, handleTOTPAPI))
+
+	// Scoped API tokens for automation
+	mux.HandleFunc("/portal/api/tokens", protect(groupAccount, handleTokensAPI))
+	mux.HandleFunc("/portal/api/tokens/", protect(groupAccount, handleTokensAPI))
+
+	// Audit log queries (admin only)
+	mux.HandleFunc("/portal/api/audit", protect(groupAdmin, handleAuditAPI))
+
+	// Brute-force lockouts (admin only)
+	mux.HandleFunc("/portal/api/blocked", protect(groupAdmin, handleBlockedAPI))
+	mux.HandleFunc("/portal/api/blocked/", protect(groupAdmin, handleBlockedAPI))
 
 	// WebSocket for terminal
-	mux.HandleFunc("/portal/ws/terminal", authMiddleware(handleTerminalWS))
+	mux.HandleFunc("/portal/ws/terminal", protect(groupTerminal, handleTerminalWS))
+	mux.HandleFunc("/portal/api/terminal/sessions", protect(groupTerminal, handleTerminalSessionsAPI))
+	mux.HandleFunc("/portal/api/terminal/sessions/", protect(groupTerminal, handleTerminalSessionsAPI))
+	mux.HandleFunc("/portal/api/terminal/stats", protect(groupAdmin, handleTerminalStatsAPI))
+	mux.HandleFunc("/portal/api/terminal/profiles", protect(groupTerminal, handleTerminalProfilesAPI))
+	mux.HandleFunc("/portal/api/terminal/recordings", protect(groupTerminal, handleRecordingsAPI))
+	mux.HandleFunc("/portal/api/terminal/recordings/", protect(groupTerminal, handleRecordingsAPI))
+
+	// Non-interactive command execution
+	mux.HandleFunc("/portal/api/exec", protect(groupExec, handleExecAPI))
 
 	// Everything else goes to Shelley (require auth)
-	mux.HandleFunc("/", authMiddleware(handleShelleyProxy))
+	mux.HandleFunc("/", protect(groupProxy, handleShelleyProxy))
 
-	log.Fatal(http.ListenAndServe(":"+portalPort, mux))
+	// PORTAL_LISTEN_ADDR 可限制监听地址，例如 127.0.0.1 (仅通过 nginx 访问)
+	log.Fatal(http.ListenAndServe(net.JoinHostPort(os.Getenv("PORTAL_LISTEN_ADDR"), portalPort), ipFilterHandler(globalIPFilter, mux)))
 }
 
 func generateToken() string {
@@ -116,6 +286,13 @@ func generateToken() string {
 	return hex.EncodeToString(b)
 }
 
+// validToken reports whether id looks like a generateToken result, so that it
+// is safe to use as a file name.
+func validToken(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
 func handlePortalStatic(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/portal/")
 	if path == "" {
@@ -141,35 +318,147 @@ func handlePortalStatic(w http.ResponseWriter, r *http.Request) {
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("portal_token")
-		if err != nil || cookie.Value != authToken {
-			headerToken := r.Header.Get("Authorization")
-			if headerToken != "Bearer "+authToken {
-				if strings.HasPrefix(r.URL.Path, "/portal/api/") || strings.HasPrefix(r.URL.Path, "/portal/ws/") {
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				} else {
-					http.Redirect(w, r, "/login", http.StatusSeeOther)
-				}
+		bearer := r.Header.Get("Authorization") != ""
+		if bearer {
+			if wait := authLimiter.Blocked(clientIP(r)); wait > 0 {
+				tooManyAttempts(w, wait)
+				return
+			}
+		}
+		p := authenticate(r)
+		if p == nil && bearer {
+			authLimiter.Fail(clientIP(r), "bearer token")
+			if wait := authLimiter.Throttled(); wait > 0 {
+				tooManyAttempts(w, wait)
 				return
 			}
 		}
-		next(w, r)
+		if p == nil {
+			if strings.HasPrefix(r.URL.Path, "/portal/api/") || strings.HasPrefix(r.URL.Path, "/portal/ws/") {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			} else {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+			}
+			return
+		}
+		if p.SessionID != "" {
+			if !csrfValid(r) {
+				http.Error(w, "CSRF check failed", http.StatusForbidden)
+				return
+			}
+			ensureCSRFCookie(w, r)
+		}
+		next(w, withPrincipal(r, p))
 	}
 }
 
+// authenticate resolves the caller from the portal_token cookie or a Bearer
+// header. The shared authToken always maps to an admin principal; API tokens
+// act as their owner, limited to their scopes.
+func authenticate(r *http.Request) *Principal {
+	if cookie, err := r.Cookie("portal_token"); err == nil {
+		if sess, ok := sessions.Touch(cookie.Value, r); ok {
+			if sess.Username == tokenUsername {
+				return &Principal{Username: tokenUsername, Role: RoleAdmin, SessionID: sess.ID}
+			}
+			if u, ok := users.Get(sess.Username); ok {
+				return &Principal{Username: u.Username, Role: u.Role, SessionID: sess.ID}
+			}
+			if isExternalUser(sess.Username) && sess.Role.valid() {
+				return &Principal{Username: sess.Username, Role: sess.Role, SessionID: sess.ID}
+			}
+		}
+	}
+	header := r.Header.Get("Authorization")
+	if secret := strings.TrimPrefix(header, "Bearer "); strings.HasPrefix(secret, apiTokenPrefix) {
+		t, ok := apiTokens.Lookup(secret, clientIP(r))
+		if !ok {
+			return nil
+		}
+		role := RoleAdmin
+		if t.Owner != tokenUsername {
+			u, ok := users.Get(t.Owner)
+			if !ok {
+				return nil
+			}
+			role = u.Role
+		}
+		return &Principal{Username: t.Owner, Role: role, TokenID: t.ID, Scopes: t.Scopes}
+	}
+	if strings.HasPrefix(header, "Bearer ") && sharedTokenMatches(strings.TrimPrefix(header, "Bearer ")) {
+		return &Principal{Username: tokenUsername, Role: RoleAdmin}
+	}
+	return nil
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		r.ParseForm()
+		if !sameOriginRequest(r) {
+			http.Error(w, "Cross-origin login rejected", http.StatusForbidden)
+			return
+		}
+		ip := clientIP(r)
+		if authLimiter.Blocked(ip) > 0 {
+			http.Redirect(w, r, "/login?error=locked", http.StatusSeeOther)
+			return
+		}
+
+		if r.FormValue("step") == "totp" {
+			if username, ok := finishMFAChallenge(w, r, r.FormValue("code")); ok {
+				auditAs(r, username, "auth.login", "totp", nil)
+				authLimiter.Succeed(ip)
+				startSession(w, r, username, "")
+				return
+			}
+			authLimiter.Fail(ip, "totp code")
+			auditAs(r, "-", "auth.login", "totp", errors.New("invalid code"))
+			if authLimiter.Throttled() > 0 {
+				http.Redirect(w, r, "/login?step=totp&error=locked", http.StatusSeeOther)
+				return
+			}
+			http.Redirect(w, r, "/login?step=totp&error=invalid", http.StatusSeeOther)
+			return
+		}
+
+		username := strings.TrimSpace(r.FormValue("username"))
 		token := r.FormValue("token")
-		if token == authToken {
-			http.SetCookie(w, &http.Cookie{
-				Name:     "portal_token",
-				Value:    token,
-				Path:     "/",
-				HttpOnly: true,
-				MaxAge:   86400 * 30,
-			})
-			http.Redirect(w, r, "/portal", http.StatusSeeOther)
+
+		loginAs := ""
+		if username == "" {
+			// 未填写用户名时按共享 token 登录
+			if sharedTokenMatches(token) {
+				loginAs = tokenUsername
+			}
+		} else if u, ok := users.Authenticate(username, token); ok {
+			loginAs = u.Username
+		}
+
+		if loginAs == "" {
+			who := "token"
+			if username != "" {
+				who = "user " + strconv.Quote(username)
+			}
+			authLimiter.Fail(ip, who)
+			auditAs(r, who, "auth.login", "", errors.New("invalid credentials"))
+			if authLimiter.Throttled() > 0 {
+				http.Redirect(w, r, "/login?error=locked", http.StatusSeeOther)
+				return
+			}
+		}
+		if loginAs != "" {
+			authLimiter.Succeed(ip)
+			if totp.Enabled(loginAs) {
+				startMFAChallenge(w, loginAs)
+				http.Redirect(w, r, "/login?step=totp", http.StatusSeeOther)
+				return
+			}
+			auditAs(r, loginAs, "auth.login", "", nil)
+			startSession(w, r, loginAs, "")
 			return
 		}
 		http.Redirect(w, r, "/login?error=invalid", http.StatusSeeOther)
@@ -177,17 +466,43 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data, _ := staticFS.ReadFile("static/login.html")
+	if oidc != nil {
+		data = []byte(strings.Replace(string(data), "<!-- oidc-login -->", oidcLoginButton, 1))
+	}
 	w.Header().Set("Content-Type", "text/html")
 	w.Write(data)
 }
 
+// startSession logs username in by issuing a new session cookie. role is
+// only given for external (OIDC) identities.
+func startSession(w http.ResponseWriter, r *http.Request, username string, role Role) {
+	cookieValue, _ := sessions.Create(username, role, r)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "portal_token",
+		Value:    cookieValue,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(sessions.maxAge / time.Second),
+	})
+	setCSRFCookie(w)
+	http.Redirect(w, r, "/portal", http.StatusSeeOther)
+}
+
 func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("portal_token"); err == nil {
+		if sess, ok := sessions.Get(sessionID(cookie.Value)); ok {
+			auditAs(r, sess.Username, "auth.logout", "", nil)
+		}
+		sessions.Revoke(sessionID(cookie.Value))
+	}
 	http.SetCookie(w, &http.Cookie{
 		Name:   "portal_token",
 		Value:  "",
 		Path:   "/",
 		MaxAge: -1,
 	})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: "", Path: "/", MaxAge: -1})
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
@@ -212,77 +527,18 @@ func handleFilesPage(w http.ResponseWriter, r *http.Request) {
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
-}
-
-func handleTerminalWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/bash"
-	}
-
-	cmd := exec.Command(shell)
-	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
-
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		log.Printf("PTY start error: %v", err)
-		return
-	}
-	defer ptmx.Close()
-
-	pty.Setsize(ptmx, &pty.Winsize{Rows: 24, Cols: 80})
-
-	go func() {
-		for {
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				return
-			}
-			if len(msg) > 0 && msg[0] == '{' {
-				var resize struct {
-					Type string `json:"type"`
-					Cols int    `json:"cols"`
-					Rows int    `json:"rows"`
-				}
-				if json.Unmarshal(msg, &resize) == nil && resize.Type == "resize" {
-					pty.Setsize(ptmx, &pty.Winsize{
-						Rows: uint16(resize.Rows),
-						Cols: uint16(resize.Cols),
-					})
-					continue
-				}
-			}
-			ptmx.Write(msg)
-		}
-	}()
-
-	buf := make([]byte, 4096)
-	for {
-		n, err := ptmx.Read(buf)
-		if err != nil {
-			return
-		}
-		if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-			return
-		}
-	}
+	CheckOrigin:     checkWebSocketOrigin,
+	Subprotocols:    []string{termProtocolV2},
 }
 
 func handleFilesAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	path := strings.TrimPrefix(r.URL.Path, "/portal/api/files")
-	if path == "" || path == "/" {
-		// 默认使用安装目录，和终端工作目录一致
-		path = baseDir
+	// 路径格式为 <root>:<相对路径>，为空时使用第一个根目录 (默认为安装目录)
+	p, ok := resolveFilePath(w, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/portal/api/files"), "/"), !isReadMethod(r.Method))
+	if !ok {
+		return
 	}
+	path := p.Abs
 
 	switch r.Method {
 	case "GET":
@@ -291,15 +547,16 @@ func handleFilesAPI(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		dir, _ := filepath.EvalSymlinks(path)
 		files := make([]FileInfo, 0, len(entries))
 		for _, entry := range entries {
 			info, err := entry.Info()
-			if err != nil {
+			if err != nil || entry.Name() == trashDirName || isPortalState(filepath.Join(dir, entry.Name())) {
 				continue
 			}
 			files = append(files, FileInfo{
 				Name:    entry.Name(),
-				Path:    filepath.Join(path, entry.Name()),
+				Path:    p.child(entry.Name()),
 				IsDir:   entry.IsDir(),
 				Size:    info.Size(),
 				ModTime: info.ModTime().Format(time.RFC3339),
@@ -312,7 +569,7 @@ func handleFilesAPI(w http.ResponseWriter, r *http.Request) {
 			}
 			return files[i].Name < files[j].Name
 		})
-		json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "files": files})
+		json.NewEncoder(w).Encode(map[string]interface{}{"path": p.Spec(), "root": p.Root.Name, "writable": p.Root.Write, "files": files})
 
 	case "POST":
 		var req struct {
@@ -320,15 +577,25 @@ func handleFilesAPI(w http.ResponseWriter, r *http.Request) {
 			Name string `json:"name"`
 		}
 		json.NewDecoder(r.Body).Decode(&req)
-		newPath := filepath.Join(path, req.Name)
+		np, ok := resolveFilePath(w, p.child(req.Name), true)
+		if !ok {
+			return
+		}
+		newPath := np.Abs
+		if np.Rel == p.Rel {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
 		if req.Type == "dir" {
 			err := os.MkdirAll(newPath, 0755)
+			audit(r, "files.mkdir", newPath, err)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		} else {
 			f, err := os.Create(newPath)
+			audit(r, "files.create", newPath, err)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -338,17 +605,41 @@ func handleFilesAPI(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 
 	case "DELETE":
-		err := os.RemoveAll(path)
+		if p.Rel == "" {
+			http.Error(w, "Cannot delete a file root", http.StatusForbidden)
+			return
+		}
+		if holdsPortalState(path) {
+			http.Error(w, "Cannot delete a directory holding portal state", http.StatusForbidden)
+			return
+		}
+		// 默认移到回收站，?permanent=1 直接删除
+		if r.URL.Query().Get("permanent") == "1" {
+			err := os.RemoveAll(path)
+			audit(r, "files.delete", path, err)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+			return
+		}
+		e, err := trash.Move(p, principalFrom(r).Username)
+		audit(r, "files.trash", path, err)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "trash_id": e.ID})
 	}
 }
 
 func handleFileAPI(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/portal/api/file")
+	p, ok := resolveFilePath(w, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/portal/api/file"), "/"), !isReadMethod(r.Method))
+	if !ok {
+		return
+	}
+	path := p.Abs
 
 	switch r.Method {
 	case "GET":
@@ -366,9 +657,15 @@ func handleFileAPI(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		etag := fileETag(content)
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"path": path, "content": string(content), "size": info.Size(), "modTime": info.ModTime().Format(time.RFC3339),
+			"path": p.Spec(), "content": string(content), "size": info.Size(), "modTime": info.ModTime().Format(time.RFC3339), "etag": etag,
 		})
 
 	case "PUT":
@@ -376,20 +673,60 @@ func handleFileAPI(w http.ResponseWriter, r *http.Request) {
 			Content string `json:"content"`
 		}
 		json.NewDecoder(r.Body).Decode(&req)
-		err := os.WriteFile(path, []byte(req.Content), 0644)
+		// 检查和写入之间不能穿插其他保存
+		fileWriteMu.Lock()
+		defer fileWriteMu.Unlock()
+		if match := r.Header.Get("If-Match"); match != "" {
+			current, err := os.ReadFile(path)
+			if err != nil && !os.IsNotExist(err) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err != nil || !etagMatch(match, fileETag(current)) {
+				// 文件已被其他人修改，返回当前版本供编辑器合并
+				audit(r, "files.write", path, errors.New("precondition failed"))
+				conflict := map[string]interface{}{"error": "file changed since it was loaded", "path": p.Spec(), "exists": err == nil}
+				if err == nil {
+					w.Header().Set("ETag", fileETag(current))
+					conflict["etag"] = fileETag(current)
+					conflict["content"] = string(current)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusPreconditionFailed)
+				json.NewEncoder(w).Encode(conflict)
+				return
+			}
+		}
+		err := writeFileAtomic(path, strings.NewReader(req.Content))
+		audit(r, "files.write", path, err)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		etag := fileETag([]byte(req.Content))
+		w.Header().Set("ETag", etag)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "etag": etag})
 
 	case "POST":
 		var req struct {
 			NewPath string `json:"newPath"`
 		}
 		json.NewDecoder(r.Body).Decode(&req)
-		err := os.Rename(path, req.NewPath)
+		np, ok := resolveFilePath(w, req.NewPath, true)
+		if !ok {
+			return
+		}
+		if p.Rel == "" || np.Rel == "" {
+			http.Error(w, "Cannot rename a file root", http.StatusForbidden)
+			return
+		}
+		if holdsPortalState(path) {
+			http.Error(w, "Cannot move a directory holding portal state", http.StatusForbidden)
+			return
+		}
+		err := os.Rename(path, np.Abs)
+		audit(r, "files.rename", path+" -> "+np.Abs, err)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -409,41 +746,52 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 获取目标目录
-	targetDir := strings.TrimPrefix(r.URL.Path, "/portal/api/upload")
-	if targetDir == "" || targetDir == "/" {
-		targetDir = baseDir
+	p, ok := resolveFilePath(w, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/portal/api/upload"), "/"), true)
+	if !ok {
+		return
 	}
 
-	// 解析 multipart form
-	err := r.ParseMultipartForm(100 << 20) // 100MB 限制
+	// 逐个读取 multipart 中的文件直接写盘，不在内存中缓冲整个表单
+	// (大文件请使用可续传的 /portal/api/uploads)
+	mr, err := r.MultipartReader()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		http.Error(w, "No files uploaded", http.StatusBadRequest)
-		return
-	}
-
-	var uploaded []string
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
+	uploaded := []string{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "files" || part.FileName() == "" {
 			continue
 		}
-		defer file.Close()
 
-		dstPath := filepath.Join(targetDir, fileHeader.Filename)
-		dst, err := os.Create(dstPath)
-		if err != nil {
+		// 只取文件名，并再次检查目标 (可能是指向根目录外的符号链接)
+		name := filepath.Base(part.FileName())
+		dp, err := resolveRootPath(p.child(name))
+		if err != nil || dp.Rel == p.Rel {
+			audit(r, "files.upload", filepath.Join(p.Abs, name), errInvalidPath)
 			continue
 		}
-		defer dst.Close()
-
-		io.Copy(dst, file)
-		uploaded = append(uploaded, fileHeader.Filename)
+		// 先写临时文件，传输中断不会留下半个文件
+		err = writeFileAtomic(dp.Abs, part)
+		audit(r, "files.upload", dp.Abs, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		uploaded = append(uploaded, name)
+	}
+	if len(uploaded) == 0 {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -455,11 +803,11 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 // 下载文件或文件夹
 func handleDownload(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/portal/api/download")
-	if path == "" {
-		http.Error(w, "Path required", http.StatusBadRequest)
+	p, ok := resolveFilePath(w, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/portal/api/download"), "/"), false)
+	if !ok {
 		return
 	}
+	path := p.Abs
 
 	info, err := os.Stat(path)
 	if err != nil {
@@ -479,7 +827,15 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return err
 			}
-			if fileInfo.IsDir() {
+			// 回收站 (包括嵌套根目录的) 同样不能打包下载
+			if isPortalState(filePath) || fileInfo.Name() == trashDirName {
+				if fileInfo.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// 跳过目录和符号链接 (链接可能指向根目录外)
+			if !fileInfo.Mode().IsRegular() {
 				return nil
 			}
 
@@ -501,24 +857,43 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		})
 	} else {
 		// 单文件
+		file, err := os.Open(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		// 以打开的文件为准，避免 Stat 之后文件被替换
+		info, err := file.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !info.Mode().IsRegular() {
+			http.Error(w, "Not a regular file", http.StatusBadRequest)
+			return
+		}
+
 		ext := filepath.Ext(path)
 		mimeType := mime.TypeByExtension(ext)
 		if mimeType == "" {
 			mimeType = "application/octet-stream"
 		}
-		
-		w.Header().Set("Content-Type", mimeType)
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(path)+"\"")
-		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
 
-		file, err := os.Open(path)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		disposition := "attachment"
+		if r.URL.Query().Get("inline") == "1" {
+			// 预览用；页面和 SVG 中的脚本不能在 portal 的源下运行
+			disposition = "inline"
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
 		}
-		defer file.Close()
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filepath.Base(path)}))
+		w.Header().Set("ETag", statETag(info))
+		w.Header().Set("Cache-Control", "private, no-cache")
 
-		io.Copy(w, file)
+		// Range、多段 Range、If-Range、If-Modified-Since、If-None-Match 和 HEAD
+		http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
 	}
 }
 
@@ -566,9 +941,19 @@ func getLatestVersion() (string, error) {
 
 func handleMgmtToken(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": authToken,
-	})
+	sharedToken.RLock()
+	defer sharedToken.RUnlock()
+	// 不再返回明文 token，仅返回掩码用于核对
+	resp := map[string]interface{}{
+		"token_masked": maskToken(authToken),
+	}
+	if !sharedToken.rotatedAt.IsZero() {
+		resp["rotated_at"] = sharedToken.rotatedAt.Format(time.RFC3339)
+	}
+	if sharedToken.previous != "" && time.Now().Before(sharedToken.previousUntil) {
+		resp["previous_valid_until"] = sharedToken.previousUntil.Format(time.RFC3339)
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleMgmtStatus(w http.ResponseWriter, r *http.Request) {
@@ -616,6 +1001,11 @@ func handleMgmtCheckUpdate(w http.ResponseWriter, r *http.Request) {
 
 func handleMgmtUpdate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	// protect 按方法选择角色，GET 只需要只读权限
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	mgmtMutex.Lock()
 	defer mgmtMutex.Unlock()
 	
@@ -630,6 +1020,7 @@ func handleMgmtUpdate(w http.ResponseWriter, r *http.Request) {
 	
 	err := cmd.Run()
 	output := stdout.String() + stderr.String()
+	audit(r, "mgmt.update", scriptPath, err)
 	
 	if err != nil {
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -697,6 +1088,11 @@ func handleMgmtBackups(w http.ResponseWriter, r *http.Request) {
 // Rollback to a specific backup
 func handleMgmtRollback(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	// protect 按方法选择角色，GET 只需要只读权限
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	mgmtMutex.Lock()
 	defer mgmtMutex.Unlock()
 	
@@ -711,11 +1107,15 @@ func handleMgmtRollback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	var result error
+	defer func() { audit(r, "mgmt.rollback", req.BackupName, result) }()
+
 	binaryPath := filepath.Join(baseDir, "shelley")
 	backupPath := filepath.Join(baseDir, req.BackupName)
 	
 	// Verify backup exists and is a valid backup file
 	if !strings.HasPrefix(req.BackupName, "shelley.backup.") {
+		result = errors.New("invalid backup name")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
 			"error":   "Invalid backup name",
@@ -724,6 +1124,7 @@ func handleMgmtRollback(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+		result = errors.New("backup not found")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
 			"error":   "Backup not found",
@@ -739,6 +1140,7 @@ func handleMgmtRollback(w http.ResponseWriter, r *http.Request) {
 	currentBackup := binaryPath + ".before-rollback." + time.Now().Format("20060102_150405")
 	if _, err := os.Stat(binaryPath); err == nil {
 		if err := copyFile(binaryPath, currentBackup); err != nil {
+			result = err
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success": false,
 				"error":   "Failed to backup current binary: " + err.Error(),
@@ -749,6 +1151,7 @@ func handleMgmtRollback(w http.ResponseWriter, r *http.Request) {
 	
 	// Copy backup to binary
 	if err := copyFile(backupPath, binaryPath); err != nil {
+		result = err
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
 			"error":   "Failed to restore backup: " + err.Error(),
@@ -788,6 +1191,52 @@ func handleMgmtRollback(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// envDuration reads a duration such as "30m" or "12h" from the environment.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads an integer from the environment.
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("Invalid %s=%q, using %d", name, v, def)
+	}
+	return def
+}
+
+// dataPath returns the location of a portal state file under baseDir/data.
+func dataPath(name string) string {
+	return filepath.Join(baseDir, "data", name)
+}
+
+// writeJSONFile atomically replaces path with the JSON encoding of v.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 // Helper function to copy file
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
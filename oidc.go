@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== OpenID Connect Login ==============
+
+// OIDCConfig describes the identity provider and how its users map to portal roles.
+type OIDCConfig struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string // empty: derived from the request host
+	Scopes         []string
+	AllowedDomains []string        // email domains allowed to sign in; empty allows any
+	GroupsClaim    string          // ID token claim holding the user's groups
+	GroupRoles     map[string]Role // group -> role; the highest matching role wins
+	DefaultRole    Role            // role for allowed users without a mapped group; empty denies them
+}
+
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is an authorization request waiting for its callback.
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	redirect string
+	expires  time.Time
+}
+
+var (
+	oidc         *oidcProvider
+	oidcPending  = make(map[string]*oidcLogin) // by state
+	oidcPendingM sync.Mutex
+)
+
+const (
+	oidcLoginTTL   = 10 * time.Minute
+	oidcClockSkew  = 2 * time.Minute
+	oidcKeysMinAge = time.Minute // how often an unknown kid may trigger a JWKS refetch
+)
+
+// loadOIDCConfig reads the PORTAL_OIDC_* variables. It returns nil when OIDC is not configured.
+func loadOIDCConfig() (*OIDCConfig, error) {
+	issuer := strings.TrimRight(os.Getenv("PORTAL_OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &OIDCConfig{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("PORTAL_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("PORTAL_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("PORTAL_OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields("openid email profile"),
+		GroupsClaim:  "groups",
+		GroupRoles:   make(map[string]Role),
+		DefaultRole:  Role(os.Getenv("PORTAL_OIDC_DEFAULT_ROLE")),
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("PORTAL_OIDC_CLIENT_ID is required")
+	}
+	if v := os.Getenv("PORTAL_OIDC_SCOPES"); v != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(v, ",", " "))
+	}
+	if v := os.Getenv("PORTAL_OIDC_GROUPS_CLAIM"); v != "" {
+		cfg.GroupsClaim = v
+	}
+	for _, d := range strings.Split(os.Getenv("PORTAL_OIDC_ALLOWED_DOMAINS"), ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			cfg.AllowedDomains = append(cfg.AllowedDomains, d)
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("PORTAL_OIDC_GROUP_ROLES"), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || !Role(role).valid() {
+			return nil, fmt.Errorf("invalid PORTAL_OIDC_GROUP_ROLES entry %q", pair)
+		}
+		cfg.GroupRoles[group] = Role(role)
+	}
+	if cfg.DefaultRole != "" && !cfg.DefaultRole.valid() {
+		return nil, fmt.Errorf("invalid PORTAL_OIDC_DEFAULT_ROLE %q", cfg.DefaultRole)
+	}
+	return cfg, nil
+}
+
+func newOIDCProvider(cfg OIDCConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover fetches and caches the provider metadata.
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(p.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	p.discovery = &d
+	return &d, nil
+}
+
+// key returns the JWKS key with id kid, refetching the key set when the kid
+// is unknown (the provider may have rotated its keys).
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if p.keys != nil && time.Since(p.keysAt) < oidcKeysMinAge {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysAt = time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if k, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = k
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	// 只有一个密钥且 token 未指定 kid 时直接使用
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// oidcClaims are the ID token claims the portal looks at.
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	AuthorizedBy  string          `json:"azp"`
+	Expiry        int64           `json:"exp"`
+	IssuedAt      int64           `json:"iat"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified *bool           `json:"email_verified"`
+	raw           map[string]interface{}
+}
+
+func (c *oidcClaims) audiences() []string {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return []string{one}
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	return many
+}
+
+// verifyIDToken checks the signature of a compact JWS ID token against the
+// provider's JWKS and validates its issuer, audience, lifetime and nonce.
+func (p *oidcProvider) verifyIDToken(token, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	b64 := base64.RawURLEncoding
+	headerJSON, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ID token signature")
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed ID token payload")
+	}
+	json.Unmarshal(payload, &claims.raw)
+
+	d, _ := p.discover()
+	if strings.TrimRight(claims.Issuer, "/") != strings.TrimRight(d.Issuer, "/") {
+		return nil, errors.New("ID token issuer mismatch")
+	}
+	auds := claims.audiences()
+	if !hasScope(auds, p.cfg.ClientID) {
+		return nil, errors.New("ID token audience mismatch")
+	}
+	if len(auds) > 1 && claims.AuthorizedBy != p.cfg.ClientID {
+		return nil, errors.New("ID token azp mismatch")
+	}
+	if claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)) {
+		return nil, errors.New("ID token expired")
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("ID token issued in the future")
+	}
+	if !secureEqual(claims.Nonce, nonce) {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return &claims, nil
+}
+
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "ES384":
+		h = crypto.SHA384
+	case "RS512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	hasher := h.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(k, h, digest, sig); err != nil {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") || len(sig)%2 != 0 {
+			break
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key type does not match algorithm %q", alg)
+}
+
+// roleFor maps verified claims to a portal role. It returns an error when the
+// user is not allowed to sign in.
+func (p *oidcProvider) roleFor(c *oidcClaims) (Role, error) {
+	if len(p.cfg.AllowedDomains) > 0 {
+		email := strings.ToLower(c.Email)
+		at := strings.LastIndex(email, "@")
+		if at < 0 || !c.emailVerified() {
+			return "", errors.New("a verified email address is required")
+		}
+		if !hasScope(p.cfg.AllowedDomains, email[at+1:]) {
+			return "", fmt.Errorf("email domain %q is not allowed", email[at+1:])
+		}
+	}
+	var role Role
+	if groups, ok := c.raw[p.cfg.GroupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			name, _ := g.(string)
+			if r, ok := p.cfg.GroupRoles[name]; ok && r.rank() > role.rank() {
+				role = r
+			}
+		}
+	}
+	if role == "" {
+		role = p.cfg.DefaultRole
+	}
+	if role == "" {
+		return "", errors.New("no portal role for this account")
+	}
+	return role, nil
+}
+
+// emailVerified reports whether the IdP vouches for the email claim. A
+// missing email_verified counts as unverified.
+func (c *oidcClaims) emailVerified() bool {
+	return c.Email != "" && c.EmailVerified != nil && *c.EmailVerified
+}
+
+// oidcUsername is the portal identity of an OIDC user. It always contains a
+// character that local usernames may not, so the two can never collide. An
+// unverified email could belong to anyone, so it falls back to the subject.
+func oidcUsername(c *oidcClaims) string {
+	if c.emailVerified() {
+		return strings.ToLower(c.Email)
+	}
+	return "oidc:" + c.Subject
+}
+
+// isExternalUser reports whether username belongs to an OIDC identity.
+func isExternalUser(username string) bool {
+	return strings.ContainsAny(username, "@:")
+}
+
+func (p *oidcProvider) redirectURL(r *http.Request) string {
+	if p.cfg.RedirectURL != "" {
+		return p.cfg.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/login/oidc/callback"
+}
+
+// exchange redeems an authorization code and returns the raw ID token.
+func (p *oidcProvider) exchange(code, verifier, redirect string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirect},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, _ := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Desc    string `json:"error_description"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		if body.Error != "" {
+			return "", fmt.Errorf("token endpoint: %s %s", body.Error, body.Desc)
+		}
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	return body.IDToken, nil
+}
+
+// pkceChallenge returns the S256 code challenge for verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ============== OIDC Handlers ==============
+
+// handleOIDCLogin starts the authorization code flow with PKCE.
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := oidc.discover()
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		http.Redirect(w, r, "/login?error=sso", http.StatusSeeOther)
+		return
+	}
+
+	state := generateToken()
+	login := &oidcLogin{
+		nonce:    generateToken(),
+		verifier: generateToken() + generateToken(),
+		redirect: oidc.redirectURL(r),
+		expires:  time.Now().Add(oidcLoginTTL),
+	}
+	oidcPendingM.Lock()
+	for k, l := range oidcPending {
+		if time.Now().After(l.expires) {
+			delete(oidcPending, k)
+		}
+	}
+	oidcPending[state] = login
+	oidcPendingM.Unlock()
+
+	// 把 state 绑定到发起登录的浏览器
+	http.SetCookie(w, &http.Cookie{
+		Name:     "portal_oidc",
+		Value:    state,
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcLoginTTL / time.Second),
+	})
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.cfg.ClientID},
+		"redirect_uri":          {login.redirect},
+		"scope":                 {strings.Join(oidc.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {pkceChallenge(login.verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// handleOIDCCallback finishes the flow and starts a portal session.
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	fail := func(reason error) {
+		log.Printf("OIDC login failed from %s: %v", clientIP(r), reason)
+		auditAs(r, "-", "auth.login", "oidc", reason)
+		http.Redirect(w, r, "/login?error=sso", http.StatusSeeOther)
+	}
+
+	q := r.URL.Query()
+	state := q.Get("state")
+	cookie, err := r.Cookie("portal_oidc")
+	if state == "" || err != nil || !secureEqual(cookie.Value, state) {
+		fail(errors.New("state mismatch"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "portal_oidc", Value: "", Path: "/login/oidc", MaxAge: -1})
+
+	oidcPendingM.Lock()
+	login, ok := oidcPending[state]
+	delete(oidcPending, state)
+	oidcPendingM.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		fail(errors.New("login request expired"))
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		fail(fmt.Errorf("provider returned %s: %s", e, q.Get("error_description")))
+		return
+	}
+
+	idToken, err := oidc.exchange(q.Get("code"), login.verifier, login.redirect)
+	if err != nil {
+		fail(err)
+		return
+	}
+	claims, err := oidc.verifyIDToken(idToken, login.nonce, time.Now())
+	if err != nil {
+		fail(err)
+		return
+	}
+	role, err := oidc.roleFor(claims)
+	if err != nil {
+		fail(fmt.Errorf("%s: %v", oidcUsername(claims), err))
+		return
+	}
+	username := oidcUsername(claims)
+	auditAs(r, username, "auth.login", "oidc ("+string(role)+")", nil)
+	startSession(w, r, username, role)
+}
+
+// oidcLoginButton is injected into login.html when OIDC is configured.
+const oidcLoginButton = `<a href="/login/oidc" class="sso-btn">Sign in with SSO</a>`
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint
+// that checks PKCE and returns whatever ID token the test queued for a code.
+type testIdP struct {
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]testIdPCode
+}
+
+type testIdPCode struct {
+	challenge string
+	idToken   string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{rsaKey: rsaKey, ecKey: ecKey, codes: make(map[string]testIdPCode)}
+
+	b64 := base64.RawURLEncoding
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.srv.URL,
+			AuthorizationEndpoint: idp.srv.URL + "/authorize",
+			TokenEndpoint:         idp.srv.URL + "/token",
+			JWKSURI:               idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{Kty: "RSA", Kid: "rsa1", Use: "sig", N: b64.EncodeToString(rsaKey.N.Bytes()), E: b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec1", Crv: "P-256", X: b64.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))), Y: b64.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		c, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || pkceChallenge(r.PostForm.Get("code_verifier")) != c.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": c.idToken, "token_type": "Bearer"})
+	})
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// sign returns a compact JWS of claims, signed with the RSA key for RS256
+// and the EC key for ES256.
+func (idp *testIdP) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "RS256":
+		s, err := rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, idp.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		t.Fatalf("unsupported alg %s", alg)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func (idp *testIdP) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            idp.srv.URL,
+		"sub":            "user-1",
+		"aud":            "portal",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "Alice@Example.com",
+		"email_verified": true,
+		"groups":         []string{"engineers"},
+	}
+}
+
+func (idp *testIdP) provider() *oidcProvider {
+	return newOIDCProvider(OIDCConfig{
+		Issuer:      idp.srv.URL,
+		ClientID:    "portal",
+		Scopes:      []string{"openid", "email"},
+		GroupsClaim: "groups",
+		GroupRoles:  map[string]Role{"engineers": RoleDeveloper},
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	now := time.Now()
+
+	with := func(key string, value interface{}) map[string]interface{} {
+		c := idp.claims("n1")
+		c[key] = value
+		return c
+	}
+	tamper := func(token string) string {
+		parts := strings.Split(token, ".")
+		payload, _ := json.Marshal(with("sub", "someone-else"))
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"RS256", idp.sign(t, "RS256", "rsa1", idp.claims("n1")), ""},
+		{"ES256", idp.sign(t, "ES256", "ec1", idp.claims("n1")), ""},
+		{"audience list without azp", idp.sign(t, "RS256", "rsa1", with("aud", []string{"other", "portal"})), "azp mismatch"},
+		{"bad RS256 signature", tamper(idp.sign(t, "RS256", "rsa1", idp.claims("n1"))), "invalid ID token signature"},
+		{"bad ES256 signature", tamper(idp.sign(t, "ES256", "ec1", idp.claims("n1"))), "invalid ID token signature"},
+		{"key of the other type", idp.sign(t, "RS256", "ec1", idp.claims("n1")), "does not match"},
+		{"unknown kid", idp.sign(t, "RS256", "rotated", idp.claims("n1")), "unknown signing key"},
+		{"wrong audience", idp.sign(t, "RS256", "rsa1", with("aud", "someone-else")), "audience mismatch"},
+		{"wrong issuer", idp.sign(t, "RS256", "rsa1", with("iss", "https://evil.example.com")), "issuer mismatch"},
+		{"nonce mismatch", idp.sign(t, "RS256", "rsa1", with("nonce", "n2")), "nonce mismatch"},
+		{"expired", idp.sign(t, "RS256", "rsa1", with("exp", now.Add(-time.Hour).Unix())), "expired"},
+		{"issued in the future", idp.sign(t, "RS256", "rsa1", with("iat", now.Add(time.Hour).Unix())), "future"},
+		{"unsigned", strings.Join(strings.Split(idp.sign(t, "RS256", "rsa1", idp.claims("n1")), ".")[:2], ".") + ".", "signature"},
+		{"malformed", "not-a-jwt", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.verifyIDToken(tt.token, "n1", now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if claims.Subject != "user-1" {
+					t.Errorf("sub = %q", claims.Subject)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCUsernameAndRole(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	verified, unverified := true, false
+
+	tests := []struct {
+		email    string
+		verified *bool
+		want     string
+	}{
+		{"Alice@Example.com", &verified, "alice@example.com"},
+		{"alice@example.com", &unverified, "oidc:user-1"},
+		{"alice@example.com", nil, "oidc:user-1"},
+		{"", &verified, "oidc:user-1"},
+	}
+	for _, tt := range tests {
+		c := &oidcClaims{Subject: "user-1", Email: tt.email, EmailVerified: tt.verified}
+		if got := oidcUsername(c); got != tt.want {
+			t.Errorf("oidcUsername(%q, %v) = %q, want %q", tt.email, tt.verified, got, tt.want)
+		}
+	}
+
+	p.cfg.AllowedDomains = []string{"example.com"}
+	c := &oidcClaims{Subject: "user-1", Email: "alice@example.com", raw: map[string]interface{}{"groups": []interface{}{"engineers"}}}
+	if _, err := p.roleFor(c); err == nil {
+		t.Error("roleFor accepted an email without email_verified")
+	}
+	c.EmailVerified = &verified
+	if role, err := p.roleFor(c); err != nil || role != RoleDeveloper {
+		t.Errorf("roleFor = %q, %v; want %q", role, err, RoleDeveloper)
+	}
+	c.Email = "alice@evil.example.org"
+	if _, err := p.roleFor(c); err == nil {
+		t.Error("roleFor accepted a domain that is not allowed")
+	}
+}
+
+// startTestOIDCLogin runs handleOIDCLogin and returns the state cookie and
+// the authorization request parameters.
+func startTestOIDCLogin(t *testing.T) (*http.Cookie, url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleOIDCLogin(rec, httptest.NewRequest("GET", "/login/oidc", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body.String())
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "portal_oidc" {
+		t.Fatalf("login cookies = %v", cookies)
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("state") != cookies[0].Value {
+		t.Fatalf("authorization request %v", q)
+	}
+	return cookies[0], q
+}
+
+func TestOIDCCallback(t *testing.T) {
+	idp := newTestIdP(t)
+	oldOIDC, oldSessions := oidc, sessions
+	t.Cleanup(func() { oidc, sessions = oldOIDC, oldSessions })
+	oidc = idp.provider()
+	var err error
+	if sessions, err = loadSessionStore(filepath.Join(t.TempDir(), "sessions.json"), time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// callback 完成登录流程；IdP 为 code 返回 token
+	callback := func(cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/login/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handleOIDCCallback(rec, req)
+		return rec
+	}
+	queue := func(q url.Values, claims map[string]interface{}) string {
+		code := generateToken()
+		idp.mu.Lock()
+		idp.codes[code] = testIdPCode{challenge: q.Get("code_challenge"), idToken: idp.sign(t, "ES256", "ec1", claims)}
+		idp.mu.Unlock()
+		return code
+	}
+	loggedIn := func(rec *httptest.ResponseRecorder) bool {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "portal_token" && c.Value != "" {
+				return rec.Header().Get("Location") == "/portal"
+			}
+		}
+		return false
+	}
+
+	t.Run("success", func(t *testing.T) {
+		cookie, q := startTestOIDCLogin(t)
+		rec := callback(cookie, q.Get("state"), queue(q, idp.claims(q.Get("nonce"))))
+		if !loggedIn(rec) {
+			t.Fatalf("not logged in: %d %v", rec.Code, rec.Header())
+		}
+		list := sessions.List("alice@example.com")
+		if len(list) != 1 || list[0].Role != RoleDeveloper {
+			t.Errorf("sessions = %+v", list)
+		}
+		// state 只能使用一次
+		if rec := callback(cookie, q.Get("state"), queue(q, idp.claims(q.Get("nonce")))); loggedIn(rec) {
+			t.Error("state accepted twice")
+		}
+	})
+
+	t.Run("state mismatch", func(t *testing.T) {
+		cookie, q := startTestOIDCLogin(t)
+		code := queue(q, idp.claims(q.Get("nonce")))
+		if rec := callback(&http.Cookie{Name: "portal_oidc", Value: generateToken()}, q.Get("state"), code); loggedIn(rec) {
+			t.Error("logged in with another browser's state cookie")
+		}
+		if rec := callback(nil, q.Get("state"), code); loggedIn(rec) {
+			t.Error("logged in without the state cookie")
+		}
+		if rec := callback(cookie, generateToken(), code); loggedIn(rec) {
+			t.Error("logged in with an unknown state")
+		}
+	})
+
+	t.Run("PKCE mismatch", func(t *testing.T) {
+		cookie, q := startTestOIDCLogin(t)
+		q.Set("code_challenge", pkceChallenge("some other verifier"))
+		rec := callback(cookie, q.Get("state"), queue(q, idp.claims(q.Get("nonce"))))
+		if loggedIn(rec) || rec.Header().Get("Location") != "/login?error=sso" {
+			t.Errorf("PKCE mismatch: %d %v", rec.Code, rec.Header())
+		}
+	})
+
+	t.Run("nonce mismatch", func(t *testing.T) {
+		cookie, q := startTestOIDCLogin(t)
+		if rec := callback(cookie, q.Get("state"), queue(q, idp.claims(generateToken()))); loggedIn(rec) {
+			t.Error("logged in with a token for another login request")
+		}
+	})
+
+	t.Run("no role", func(t *testing.T) {
+		cookie, q := startTestOIDCLogin(t)
+		claims := idp.claims(q.Get("nonce"))
+		claims["groups"] = []string{"visitors"}
+		if rec := callback(cookie, q.Get("state"), queue(q, claims)); loggedIn(rec) {
+			t.Error("logged in without a mapped role")
+		}
+	})
+}
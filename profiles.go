@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ============== Portal Config File ==============
+
+// PortalConfig holds settings that do not fit in environment variables. It is
+// read from PORTAL_CONFIG (default data/portal-config.json) at startup.
+type PortalConfig struct {
+	TerminalProfiles []*TerminalProfile `json:"terminal_profiles"`
+	FileRoots        []*FileRoot        `json:"file_roots"` // default: workspace and home
+}
+
+var portalConfig = &PortalConfig{}
+
+func loadPortalConfig(path string) (*PortalConfig, error) {
+	c := &PortalConfig{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		c.FileRoots = defaultFileRoots()
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for _, p := range c.TerminalProfiles {
+		if p == nil || p.Name == "" {
+			return nil, fmt.Errorf("%s: terminal profile without a name", path)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("%s: duplicate terminal profile %q", path, p.Name)
+		}
+		seen[p.Name] = true
+		for k := range p.Env {
+			if k == "" || strings.ContainsAny(k, "=\x00") {
+				return nil, fmt.Errorf("%s: profile %q: invalid env name %q", path, p.Name, k)
+			}
+		}
+	}
+	seen = make(map[string]bool)
+	for _, fr := range c.FileRoots {
+		if fr == nil || fr.Name == "" || strings.ContainsAny(fr.Name, ":/") {
+			return nil, fmt.Errorf("%s: file root needs a name without ':' or '/'", path)
+		}
+		if seen[fr.Name] {
+			return nil, fmt.Errorf("%s: duplicate file root %q", path, fr.Name)
+		}
+		seen[fr.Name] = true
+		if fr.Path == "" {
+			return nil, fmt.Errorf("%s: file root %q has no path", path, fr.Name)
+		}
+	}
+	if len(c.FileRoots) == 0 {
+		c.FileRoots = defaultFileRoots()
+	}
+	return c, nil
+}
+
+// ============== Terminal Profiles ==============
+
+// TerminalProfile describes how to launch a terminal, e.g. "bash in the
+// project directory" or "python REPL". A profile named "default" replaces
+// the built-in default ($SHELL or /bin/bash in baseDir).
+type TerminalProfile struct {
+	Name  string            `json:"name"`
+	Shell string            `json:"shell"` // default $SHELL or /bin/bash
+	Args  []string          `json:"args,omitempty"`
+	Cwd   string            `json:"cwd,omitempty"` // relative to baseDir; default baseDir
+	Env   map[string]string `json:"env,omitempty"`
+	Login bool              `json:"login,omitempty"` // start as a login shell (argv[0] "-bash")
+}
+
+// terminalProfile returns the named profile, or the default one for "".
+func terminalProfile(name string) (*TerminalProfile, error) {
+	for _, p := range portalConfig.TerminalProfiles {
+		if p.Name == name || (name == "" && p.Name == "default") {
+			return p, nil
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("unknown terminal profile: %s", name)
+	}
+	return &TerminalProfile{}, nil
+}
+
+// dir resolves the profile's working directory.
+func (p *TerminalProfile) dir() string {
+	if p.Cwd == "" {
+		return baseDir
+	}
+	if filepath.IsAbs(p.Cwd) {
+		return p.Cwd
+	}
+	return filepath.Join(baseDir, p.Cwd)
+}
+
+// environ returns the environment for a shell started from p.
+func (p *TerminalProfile) environ() []string {
+	env := append(os.Environ(), "TERM=xterm-256color")
+	keys := make([]string, 0, len(p.Env))
+	for k := range p.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+p.Env[k])
+	}
+	return env
+}
+
+// handleTerminalProfilesAPI lists the configured profiles (without their
+// environment, which may hold secrets):
+//
+//	GET /portal/api/terminal/profiles
+func handleTerminalProfilesAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := []TerminalProfile{}
+	for _, p := range portalConfig.TerminalProfiles {
+		list = append(list, TerminalProfile{Name: p.Name, Shell: p.Shell, Args: p.Args, Cwd: p.dir(), Login: p.Login})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"profiles": list})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== Client Address ==============
+
+// trustedProxies lists the proxies whose X-Forwarded-For and X-Real-IP
+// headers are believed.
+var trustedProxies []*net.IPNet
+
+// parseCIDRList parses a comma separated list of IPs and CIDRs.
+func parseCIDRList(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made r. X-Forwarded-For and
+// X-Real-IP are only honoured when the direct peer is a trusted proxy.
+// X-Forwarded-For is walked from the right, skipping further trusted proxies;
+// X-Real-IP is used when X-Forwarded-For is absent.
+func clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	ip := net.ParseIP(peer)
+	if ip == nil || !ipInNets(ip, trustedProxies) {
+		return peer
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			if !ipInNets(hop, trustedProxies) {
+				return hop.String()
+			}
+		}
+		return peer
+	}
+	if xri := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); xri != nil {
+		return xri.String()
+	}
+	return peer
+}
+
+// ============== Brute-force Protection ==============
+
+type ipFailures struct {
+	Failures     int       `json:"failures"`
+	LastFailure  time.Time `json:"last_failure"`
+	BlockedUntil time.Time `json:"blocked_until"`
+}
+
+// AuthLimiter tracks failed login and Bearer attempts. After threshold
+// failures an IP is locked out, with the lockout doubling on every further
+// failure up to maxBlock. When the failures of all clients within one minute
+// exceed globalLimit, further failed attempts are refused until the minute is
+// over; valid credentials are still accepted.
+type AuthLimiter struct {
+	mu          sync.Mutex
+	ips         map[string]*ipFailures
+	threshold   int
+	baseBlock   time.Duration
+	maxBlock    time.Duration
+	globalLimit int
+	globalCount int
+	globalStart time.Time
+}
+
+var authLimiter *AuthLimiter
+
+// failureMemory is how long an IP's failure count is kept after its last failure.
+const failureMemory = 24 * time.Hour
+
+func newAuthLimiter(threshold int, baseBlock, maxBlock time.Duration, globalLimit int) *AuthLimiter {
+	l := &AuthLimiter{
+		ips:         make(map[string]*ipFailures),
+		threshold:   threshold,
+		baseBlock:   baseBlock,
+		maxBlock:    maxBlock,
+		globalLimit: globalLimit,
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			l.mu.Lock()
+			now := time.Now()
+			for ip, f := range l.ips {
+				if now.Sub(f.LastFailure) > failureMemory && now.After(f.BlockedUntil) {
+					delete(l.ips, ip)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// Blocked returns how long ip still has to wait before it may try again.
+func (l *AuthLimiter) Blocked(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if f, ok := l.ips[ip]; ok && now.Before(f.BlockedUntil) {
+		return f.BlockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// Throttled returns how long failed attempts are still refused because the
+// global failure budget of the current minute is used up. It is only checked
+// after a credential has been rejected, so failures from other clients never
+// lock out a valid token or password.
+func (l *AuthLimiter) Throttled() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.globalLimit > 0 && l.globalCount >= l.globalLimit && now.Sub(l.globalStart) < time.Minute {
+		return l.globalStart.Add(time.Minute).Sub(now)
+	}
+	return 0
+}
+
+// Fail records a failed attempt from ip.
+func (l *AuthLimiter) Fail(ip, who string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.globalStart) >= time.Minute {
+		l.globalStart = now
+		l.globalCount = 0
+	}
+	l.globalCount++
+
+	f := l.ips[ip]
+	if f == nil {
+		f = &ipFailures{}
+		l.ips[ip] = f
+	}
+	f.Failures++
+	f.LastFailure = now
+	if f.Failures >= l.threshold {
+		block := l.maxBlock
+		if exp := f.Failures - l.threshold; exp < 30 {
+			if b := l.baseBlock << exp; b > 0 && b < l.maxBlock {
+				block = b
+			}
+		}
+		f.BlockedUntil = now.Add(block)
+		log.Printf("Auth failure from %s (%s), %d failures, blocked for %s", ip, who, f.Failures, block)
+		return
+	}
+	log.Printf("Auth failure from %s (%s), %d failures", ip, who, f.Failures)
+}
+
+// Succeed clears the failure count of ip.
+func (l *AuthLimiter) Succeed(ip string) {
+	l.mu.Lock()
+	delete(l.ips, ip)
+	l.mu.Unlock()
+}
+
+// List returns the IPs that are blocked or have recent failures.
+func (l *AuthLimiter) List() map[string]ipFailures {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]ipFailures, len(l.ips))
+	for ip, f := range l.ips {
+		out[ip] = *f
+	}
+	return out
+}
+
+// Clear unblocks ip, or every IP (and the global counter) if ip is empty.
+func (l *AuthLimiter) Clear(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ip == "" {
+		l.ips = make(map[string]*ipFailures)
+		l.globalCount = 0
+		return
+	}
+	delete(l.ips, ip)
+}
+
+// tooManyAttempts answers a request from a locked out client.
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+}
+
+// ============== Blocked IPs API ==============
+
+func handleBlockedAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ip := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/blocked"), "/")
+
+	switch r.Method {
+	case "GET":
+		type entry struct {
+			IP           string `json:"ip"`
+			Failures     int    `json:"failures"`
+			LastFailure  string `json:"last_failure"`
+			Blocked      bool   `json:"blocked"`
+			BlockedUntil string `json:"blocked_until,omitempty"`
+		}
+		now := time.Now()
+		list := make([]entry, 0)
+		for addr, f := range authLimiter.List() {
+			e := entry{
+				IP:          addr,
+				Failures:    f.Failures,
+				LastFailure: f.LastFailure.Format(time.RFC3339),
+				Blocked:     now.Before(f.BlockedUntil),
+			}
+			if e.Blocked {
+				e.BlockedUntil = f.BlockedUntil.Format(time.RFC3339)
+			}
+			list = append(list, e)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].LastFailure > list[j].LastFailure })
+		json.NewEncoder(w).Encode(map[string]interface{}{"ips": list})
+
+	case "DELETE":
+		authLimiter.Clear(ip)
+		audit(r, "blocked.clear", ip, nil)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
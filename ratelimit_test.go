@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthMiddlewareGlobalLimit(t *testing.T) {
+	oldLimiter, oldToken := authLimiter, authToken
+	t.Cleanup(func() { authLimiter, authToken = oldLimiter, oldToken })
+	authLimiter = newAuthLimiter(5, time.Minute, time.Hour, 3)
+	authToken = "good-token"
+
+	h := authMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+	call := func(token string) int {
+		req := httptest.NewRequest("GET", "/portal/api/files/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+
+	// 其他客户端用完本分钟的全局失败额度
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		authLimiter.Fail(ip, "test")
+	}
+	if authLimiter.Blocked("192.0.2.1") != 0 {
+		t.Fatal("global failures blocked an unrelated IP")
+	}
+	if code := call("good-token"); code != http.StatusOK {
+		t.Errorf("valid token: status %d, want 200", code)
+	}
+	if code := call("bad-token"); code != http.StatusTooManyRequests {
+		t.Errorf("invalid token: status %d, want 429", code)
+	}
+
+	authLimiter.Clear("")
+	if code := call("bad-token"); code != http.StatusUnauthorized {
+		t.Errorf("invalid token after clear: status %d, want 401", code)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ============== Terminal Recording (asciicast v2) ==============
+
+// RecordingStore keeps asciicast v2 files of terminal sessions and prunes
+// them by age and total size.
+type RecordingStore struct {
+	mu       sync.Mutex
+	dir      string
+	all      bool          // record every session unless asked not to
+	maxAge   time.Duration // 0: keep forever
+	maxBytes int64         // 0: no size limit
+	active   map[string]*castRecorder
+}
+
+var recordings *RecordingStore
+
+func newRecordingStore(dir string, all bool, maxAge time.Duration, maxBytes int64) (*RecordingStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &RecordingStore{dir: dir, all: all, maxAge: maxAge, maxBytes: maxBytes, active: make(map[string]*castRecorder)}
+	s.Prune()
+	go func() {
+		for range time.Tick(time.Hour) {
+			s.Prune()
+		}
+	}()
+	return s, nil
+}
+
+func (s *RecordingStore) path(id string) string {
+	return filepath.Join(s.dir, id+".cast")
+}
+
+// castHeader is the first line of an asciicast v2 file. Owner and SessionID
+// are portal extensions; players ignore unknown keys.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Owner     string            `json:"portal_owner,omitempty"`
+	SessionID string            `json:"portal_session,omitempty"`
+}
+
+// Start begins recording session sess.
+func (s *RecordingStore) Start(sess *TermSession, rows, cols int) (*castRecorder, error) {
+	f, err := os.OpenFile(s.path(sess.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rec := &castRecorder{store: s, id: sess.ID, f: f, w: bufio.NewWriter(f), start: time.Now()}
+	rec.line(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: rec.start.Unix(),
+		Title:     sess.Name(),
+		Env:       map[string]string{"SHELL": sess.Shell, "TERM": "xterm-256color"},
+		Owner:     sess.Owner,
+		SessionID: sess.ID,
+	})
+	s.mu.Lock()
+	s.active[sess.ID] = rec
+	s.mu.Unlock()
+	return rec, nil
+}
+
+// Prune removes recordings older than maxAge, then the oldest ones until the
+// total size fits in maxBytes. Recordings in progress are never removed.
+func (s *RecordingStore) Prune() {
+	list := s.List(nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for _, r := range list {
+		total += r.Size
+	}
+	// List 按时间倒序，从最旧的开始删除
+	for i := len(list) - 1; i >= 0; i-- {
+		r := list[i]
+		if _, ok := s.active[r.ID]; ok {
+			continue
+		}
+		tooOld := s.maxAge > 0 && time.Since(r.StartedAt) > s.maxAge
+		tooBig := s.maxBytes > 0 && total > s.maxBytes
+		if !tooOld && !tooBig {
+			continue
+		}
+		if err := os.Remove(s.path(r.ID)); err == nil {
+			total -= r.Size
+		}
+	}
+}
+
+// RecordingInfo is the API view of a recording.
+type RecordingInfo struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Owner     string    `json:"owner"`
+	StartedAt time.Time `json:"started_at"`
+	Size      int64     `json:"size"`
+	Active    bool      `json:"active"`
+}
+
+// List returns the recordings p may see (all for a nil principal or an
+// admin), newest first.
+func (s *RecordingStore) List(p *Principal) []RecordingInfo {
+	entries, _ := os.ReadDir(s.dir)
+	list := []RecordingInfo{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".cast")
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, ok := s.Get(id)
+		if !ok || (p != nil && p.Role != RoleAdmin && info.Owner != p.Username) {
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list
+}
+
+// Get reads a recording's header.
+func (s *RecordingStore) Get(id string) (RecordingInfo, bool) {
+	if !validRecordingID(id) {
+		return RecordingInfo{}, false
+	}
+	f, err := os.Open(s.path(id))
+	if err != nil {
+		return RecordingInfo{}, false
+	}
+	defer f.Close()
+	st, _ := f.Stat()
+	var h castHeader
+	line, _ := bufio.NewReader(f).ReadBytes('\n')
+	if json.Unmarshal(line, &h) != nil || h.Version != 2 {
+		return RecordingInfo{}, false
+	}
+	s.mu.Lock()
+	_, active := s.active[id]
+	s.mu.Unlock()
+	return RecordingInfo{
+		ID:        id,
+		Title:     h.Title,
+		Owner:     h.Owner,
+		StartedAt: time.Unix(h.Timestamp, 0).UTC(),
+		Size:      st.Size(),
+		Active:    active,
+	}, true
+}
+
+func validRecordingID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *RecordingStore) isActive(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.active[id]
+	return ok
+}
+
+// castRecorder writes the events of one session. Output and input are cut at
+// UTF-8 character boundaries because asciicast stores them as JSON strings.
+type castRecorder struct {
+	store *RecordingStore
+	id    string
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	pending map[string][]byte // incomplete UTF-8 sequences per event type
+	failed  bool
+}
+
+func (r *castRecorder) line(v interface{}) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		r.w.Write(data)
+		err = r.w.WriteByte('\n')
+	}
+	if err != nil && !r.failed {
+		r.failed = true
+		log.Printf("Recording %s failed: %v", r.id, err)
+	}
+}
+
+func (r *castRecorder) event(kind string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil || r.failed {
+		return
+	}
+	if r.pending == nil {
+		r.pending = make(map[string][]byte)
+	}
+	var text []byte
+	text, r.pending[kind] = splitUTF8(append(r.pending[kind], data...))
+	if len(text) == 0 {
+		return
+	}
+	t := time.Since(r.start).Seconds()
+	r.line([]interface{}{float64(int64(t*1e6)) / 1e6, kind, string(text)})
+	r.w.Flush()
+}
+
+// splitUTF8 splits off an incomplete UTF-8 sequence at the end of data, so a
+// character cut between two reads is not turned into U+FFFD. The rest should
+// be prepended to the next read.
+func splitUTF8(data []byte) (text, rest []byte) {
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	return data[:cut], append([]byte(nil), data[cut:]...)
+}
+
+func (r *castRecorder) Output(data []byte) { r.event("o", data) }
+func (r *castRecorder) Input(data []byte)  { r.event("i", data) }
+
+func (r *castRecorder) Resize(rows, cols int) {
+	r.event("r", []byte(fmt.Sprintf("%dx%d", cols, rows)))
+}
+
+// Close finishes the recording and applies the retention limits.
+func (r *castRecorder) Close() {
+	r.mu.Lock()
+	if r.f != nil {
+		r.w.Flush()
+		r.f.Close()
+		r.f = nil
+	}
+	r.mu.Unlock()
+	r.store.mu.Lock()
+	delete(r.store.active, r.id)
+	r.store.mu.Unlock()
+	r.store.Prune()
+}
+
+// ============== Recordings API ==============
+
+// handleRecordingsAPI lists, downloads and deletes recordings:
+//
+//	GET    /portal/api/terminal/recordings           list
+//	GET    /portal/api/terminal/recordings/<id>      download (?follow=1 streams a live session)
+//	DELETE /portal/api/terminal/recordings/<id>      delete (admin only)
+func handleRecordingsAPI(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/terminal/recordings"), "/")
+
+	if id == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recordings": recordings.List(p)})
+		return
+	}
+
+	info, ok := recordings.Get(id)
+	if !ok || (p.Role != RoleAdmin && info.Owner != p.Username) {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f, err := os.Open(recordings.path(id))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		audit(r, "recordings.download", id, nil)
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		if r.URL.Query().Get("follow") == "" {
+			w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.cast"`)
+			io.Copy(w, f)
+			return
+		}
+		followRecording(w, r, f, id)
+
+	case "DELETE":
+		if p.Role != RoleAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if info.Active {
+			http.Error(w, "Recording in progress", http.StatusConflict)
+			return
+		}
+		err := os.Remove(recordings.path(id))
+		audit(r, "recordings.delete", id, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// followRecording streams a recording like "tail -f" until the session ends
+// or the client goes away.
+func followRecording(w http.ResponseWriter, r *http.Request, f *os.File, id string) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return
+		}
+		if !recordings.isActive(id) {
+			// 录制结束后再读一次，取走最后写入的内容
+			io.Copy(w, f)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ============== File Roots ==============
+
+// FileRoot is a directory the file APIs may access. Files are addressed as
+// "<root>:<relative/path>", e.g. "workspace:app/main.go"; nothing outside
+// the configured roots can be reached.
+type FileRoot struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"` // relative to baseDir when not absolute
+	Read  bool   `json:"read"`
+	Write bool   `json:"write"`
+}
+
+// defaultFileRoots is used when the config file defines no file_roots. The
+// home directory holds shell profiles and SSH keys, so it is read-only unless
+// the config says otherwise.
+func defaultFileRoots() []*FileRoot {
+	roots := []*FileRoot{{Name: "workspace", Path: baseDir, Read: true, Write: true}}
+	if home, err := os.UserHomeDir(); err == nil && filepath.Clean(home) != filepath.Clean(baseDir) {
+		roots = append(roots, &FileRoot{Name: "home", Path: home, Read: true})
+	}
+	return roots
+}
+
+// dir returns the root's absolute directory.
+func (fr *FileRoot) dir() string {
+	if filepath.IsAbs(fr.Path) {
+		return filepath.Clean(fr.Path)
+	}
+	return filepath.Join(baseDir, fr.Path)
+}
+
+// fileRoot returns the named root; "" is the first one.
+func fileRoot(name string) *FileRoot {
+	for _, fr := range portalConfig.FileRoots {
+		if fr.Name == name || name == "" {
+			return fr
+		}
+	}
+	return nil
+}
+
+var (
+	errUnknownRoot  = errors.New("unknown file root")
+	errInvalidPath  = errors.New("invalid path")
+	errPathEscapes  = errors.New("path escapes its root")
+	errDanglingLink = errors.New("dangling symlink")
+	errPortalState  = errors.New("portal state is not reachable through the file API")
+)
+
+// portalStatePaths are the portal's own secrets and state (.env, data/, the
+// config file and the audit log with its rotated files), which usually live inside the default workspace root. They
+// are stored with symlinks resolved; a path also covers its siblings with
+// an extra suffix, like .env.tmp123.
+var portalStatePaths []string
+
+// protectPortalState hides paths from the file APIs.
+func protectPortalState(paths ...string) {
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		if real, err := evalExisting(abs); err == nil {
+			abs = real
+		}
+		portalStatePaths = append(portalStatePaths, abs)
+	}
+}
+
+// isPortalState reports whether the resolved path p is portal state.
+func isPortalState(p string) bool {
+	for _, s := range portalStatePaths {
+		if withinDir(s, p) || strings.HasPrefix(p, s+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// holdsPortalState reports whether the resolved path p is portal state or a
+// directory containing it, which must not be deleted or moved either.
+func holdsPortalState(p string) bool {
+	for _, s := range portalStatePaths {
+		if withinDir(p, s) {
+			return true
+		}
+	}
+	return isPortalState(p)
+}
+
+// rootPath is a file path resolved against a root.
+type rootPath struct {
+	Root *FileRoot
+	Rel  string // slash-separated, "" for the root itself
+	Abs  string // the path to operate on; its parent has no symlinks
+}
+
+// Spec returns the path in "<root>:<rel>" form.
+func (p *rootPath) Spec() string {
+	return p.Root.Name + ":" + p.Rel
+}
+
+// child returns the spec of name inside p.
+func (p *rootPath) child(name string) string {
+	if p.Rel == "" {
+		return p.Spec() + name
+	}
+	return p.Spec() + "/" + name
+}
+
+// resolveRootPath resolves "<root>:<rel>" to a path inside the root. ".."
+// segments are rejected outright, and symlinks are followed only as far as
+// they stay inside the root (the root directory itself may be a symlink).
+// The final component is not resolved in Abs, so deleting or renaming a
+// symlink affects the link, while opening it reaches a target that was
+// checked to be inside the root.
+//
+// Like any check-then-use scheme this cannot stop a process that swaps a
+// directory for a symlink between the check and the operation; it is meant
+// to confine API clients, not local users who can already write the tree.
+func resolveRootPath(spec string) (*rootPath, error) {
+	name, rel, ok := strings.Cut(spec, ":")
+	if !ok || name == "" {
+		return nil, errUnknownRoot
+	}
+	fr := fileRoot(name)
+	if fr == nil {
+		return nil, errUnknownRoot
+	}
+	if strings.ContainsRune(rel, 0) {
+		return nil, errInvalidPath
+	}
+	for _, seg := range strings.Split(rel, "/") {
+		if seg == ".." {
+			return nil, errPathEscapes
+		}
+	}
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+
+	top, err := filepath.EvalSymlinks(fr.dir())
+	if err != nil {
+		return nil, err
+	}
+	p := &rootPath{Root: fr, Rel: rel, Abs: top}
+	if isPortalState(top) {
+		return nil, errPortalState
+	}
+	if rel == "" {
+		return p, nil
+	}
+	parent, err := evalExisting(filepath.Dir(filepath.Join(top, filepath.FromSlash(rel))))
+	if err != nil {
+		return nil, err
+	}
+	target, err := evalExisting(filepath.Join(parent, path.Base(rel)))
+	if err != nil {
+		return nil, err
+	}
+	if !withinDir(top, parent) || !withinDir(top, target) {
+		return nil, errPathEscapes
+	}
+	// 根目录可能互相嵌套，任何一层回收站都不能直接访问
+	sep := string(filepath.Separator)
+	if strings.Contains(target+sep, sep+trashDirName+sep) {
+		return nil, errTrashPath
+	}
+	if isPortalState(target) {
+		return nil, errPortalState
+	}
+	p.Abs = filepath.Join(parent, path.Base(rel))
+	return p, nil
+}
+
+// evalExisting resolves the symlinks in the longest existing prefix of p and
+// appends the rest unchanged.
+func evalExisting(p string) (string, error) {
+	var rest []string
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(p); lerr == nil {
+			// p 存在但指向不存在的目标，创建文件时会写到链接目标
+			return "", errDanglingLink
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// withinDir reports whether p is dir or below it.
+func withinDir(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// resolveFilePath resolves spec for a file API request and checks the root's
+// read or write flag, writing the error response on failure. An empty spec
+// is the first root.
+func resolveFilePath(w http.ResponseWriter, spec string, write bool) (*rootPath, bool) {
+	if spec == "" {
+		if fr := fileRoot(""); fr != nil {
+			spec = fr.Name + ":"
+		}
+	}
+	p, err := resolveRootPath(spec)
+	switch {
+	case errors.Is(err, errUnknownRoot), os.IsNotExist(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	case errors.Is(err, errPathEscapes), errors.Is(err, errDanglingLink), errors.Is(err, errTrashPath), errors.Is(err, errPortalState):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if write && !p.Root.Write {
+		http.Error(w, "File root "+p.Root.Name+" is read-only", http.StatusForbidden)
+		return nil, false
+	}
+	if !write && !p.Root.Read {
+		http.Error(w, "File root "+p.Root.Name+" is write-only", http.StatusForbidden)
+		return nil, false
+	}
+	return p, true
+}
+
+// handleFileRootsAPI lists the roots:
+//
+//	GET /portal/api/roots
+func handleFileRootsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := []FileRoot{}
+	for _, fr := range portalConfig.FileRoots {
+		list = append(list, FileRoot{Name: fr.Name, Path: fr.dir(), Read: fr.Read, Write: fr.Write})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"roots": list})
+}
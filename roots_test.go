@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupRoots points baseDir and the file roots at a fresh temporary
+// directory and returns the workspace directory.
+func setupRoots(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldBase, oldConfig, oldState := baseDir, portalConfig, portalStatePaths
+	t.Cleanup(func() { baseDir, portalConfig, portalStatePaths = oldBase, oldConfig, oldState })
+
+	baseDir = filepath.Join(dir, "portal")
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	portalConfig = &PortalConfig{FileRoots: []*FileRoot{{Name: "workspace", Path: baseDir, Read: true, Write: true}}}
+	portalStatePaths = nil
+	return baseDir
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveRootPathPortalState(t *testing.T) {
+	ws := setupRoots(t)
+	writeTestFile(t, filepath.Join(ws, ".env"), "PORTAL_TOKEN=secret\n")
+	writeTestFile(t, filepath.Join(ws, "data", "portal-users.json"), "{}")
+	writeTestFile(t, filepath.Join(ws, "logs", "portal-audit.log"), "")
+	writeTestFile(t, filepath.Join(ws, "app", "main.go"), "package main\n")
+	if err := os.Symlink(filepath.Join(ws, "data"), filepath.Join(ws, "app", "data-link")); err != nil {
+		t.Fatal(err)
+	}
+	protectPortalState(envFilePath(), dataPath(""), filepath.Join(ws, "logs", "portal-audit.log"))
+
+	for _, spec := range []string{
+		"workspace:.env",
+		"workspace:.env.tmp123",
+		"workspace:data",
+		"workspace:data/portal-users.json",
+		"workspace:data/new.json",
+		"workspace:logs/portal-audit.log",
+		"workspace:logs/portal-audit.log.1",
+		"workspace:app/data-link",
+		"workspace:app/data-link/portal-users.json",
+	} {
+		if _, err := resolveRootPath(spec); !errors.Is(err, errPortalState) {
+			t.Errorf("resolveRootPath(%q) error = %v, want %v", spec, err, errPortalState)
+		}
+	}
+	for _, spec := range []string{"workspace:", "workspace:app/main.go", "workspace:logs", "workspace:.envrc"} {
+		if _, err := resolveRootPath(spec); err != nil {
+			t.Errorf("resolveRootPath(%q) error = %v", spec, err)
+		}
+	}
+
+	if !holdsPortalState(ws) || holdsPortalState(filepath.Join(ws, "app")) {
+		t.Error("holdsPortalState should cover exactly the directories containing portal state")
+	}
+
+	// 文件 API 返回 403，目录列表中也不出现
+	req := httptest.NewRequest("GET", "/portal/api/file/workspace:.env", nil)
+	rec := httptest.NewRecorder()
+	handleFileAPI(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET workspace:.env: status %d, want 403", rec.Code)
+	}
+	req = httptest.NewRequest("GET", "/portal/api/files/workspace:", nil)
+	rec = httptest.NewRecorder()
+	handleFilesAPI(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET workspace:: status %d", rec.Code)
+	}
+	for _, hidden := range []string{`".env"`, `"data"`} {
+		if strings.Contains(rec.Body.String(), hidden) {
+			t.Errorf("listing shows %s: %s", hidden, rec.Body.String())
+		}
+	}
+}
+
+// setupTraversal creates a workspace with a secret file next to it and the
+// symlinks used by the traversal tests.
+func setupTraversal(t *testing.T) (ws, outside string) {
+	t.Helper()
+	ws = setupRoots(t)
+	outside = filepath.Join(filepath.Dir(ws), "outside")
+	writeTestFile(t, filepath.Join(outside, "secret"), "top secret")
+	writeTestFile(t, filepath.Join(ws, "app", "main.go"), "package main\n")
+	for link, target := range map[string]string{
+		"out-dir":  outside,
+		"out-file": filepath.Join(outside, "secret"),
+		"dangling": filepath.Join(outside, "missing"),
+		"in-dir":   filepath.Join(ws, "app"),
+		"rel-out":  "../outside",
+	} {
+		if err := os.Symlink(target, filepath.Join(ws, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ws, outside
+}
+
+func TestResolveRootPathTraversal(t *testing.T) {
+	ws, _ := setupTraversal(t)
+	realWS, err := filepath.EvalSymlinks(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec string
+		want error
+	}{
+		{"workspace:../outside/secret", errPathEscapes},
+		{"workspace:app/../../outside/secret", errPathEscapes},
+		{"workspace:app/..", errPathEscapes},
+		{"workspace:/../outside", errPathEscapes},
+		{"workspace:out-dir/secret", errPathEscapes},  // 上级目录是指向根目录外的符号链接
+		{"workspace:out-dir/new.txt", errPathEscapes}, // 新建文件也不行
+		{"workspace:rel-out/secret", errPathEscapes},  // 相对链接
+		{"workspace:out-file", errPathEscapes},        // 最后一级是指向根目录外的符号链接
+		{"workspace:dangling", errDanglingLink},       // 写入会创建链接目标
+		{"workspace:app/main.go\x00.txt", errInvalidPath},
+		{"nope:app", errUnknownRoot},
+		{"app/main.go", errUnknownRoot},
+	}
+	for _, tt := range tests {
+		if _, err := resolveRootPath(tt.spec); !errors.Is(err, tt.want) {
+			t.Errorf("resolveRootPath(%q) error = %v, want %v", tt.spec, err, tt.want)
+		}
+	}
+
+	ok := []struct{ spec, abs string }{
+		{"workspace:", realWS},
+		{"workspace:app/main.go", filepath.Join(realWS, "app", "main.go")},
+		{"workspace:/app//main.go", filepath.Join(realWS, "app", "main.go")},
+		{"workspace:app/new/dir/file.txt", filepath.Join(realWS, "app", "new", "dir", "file.txt")},
+		{"workspace:in-dir/main.go", filepath.Join(realWS, "app", "main.go")}, // 根目录内的链接可以访问
+		{"workspace:in-dir", filepath.Join(realWS, "in-dir")},                 // 最后一级不解析
+	}
+	for _, tt := range ok {
+		p, err := resolveRootPath(tt.spec)
+		if err != nil {
+			t.Errorf("resolveRootPath(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if p.Abs != tt.abs {
+			t.Errorf("resolveRootPath(%q).Abs = %q, want %q", tt.spec, p.Abs, tt.abs)
+		}
+	}
+}
+
+func TestResolveRootPathSymlinkedRoot(t *testing.T) {
+	ws, _ := setupTraversal(t)
+	realWS, err := filepath.EvalSymlinks(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(filepath.Dir(ws), "ws-link")
+	if err := os.Symlink(ws, link); err != nil {
+		t.Fatal(err)
+	}
+	portalConfig.FileRoots = append(portalConfig.FileRoots, &FileRoot{Name: "linked", Path: link, Read: true})
+
+	p, err := resolveRootPath("linked:app/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(realWS, "app", "main.go"); p.Abs != want {
+		t.Errorf("Abs = %q, want %q", p.Abs, want)
+	}
+	for _, spec := range []string{"linked:out-dir/secret", "linked:out-file", "linked:../outside/secret"} {
+		if _, err := resolveRootPath(spec); !errors.Is(err, errPathEscapes) {
+			t.Errorf("resolveRootPath(%q) error = %v, want %v", spec, err, errPathEscapes)
+		}
+	}
+}
+
+func TestFileHandlersRejectEncodedTraversal(t *testing.T) {
+	setupTraversal(t)
+
+	handlers := map[string]http.HandlerFunc{
+		"/portal/api/file/":     handleFileAPI,
+		"/portal/api/files/":    handleFilesAPI,
+		"/portal/api/download/": handleDownload,
+	}
+	for prefix, h := range handlers {
+		for _, rest := range []string{
+			"workspace:%2e%2e/outside/secret",
+			"workspace:%2E%2E%2Foutside%2Fsecret",
+			"workspace:app%2f..%2f..%2foutside%2fsecret",
+			"workspace:app/%2e%2e/%2e%2e/outside/secret",
+			"workspace:out-dir%2fsecret",
+			"workspace:out-file",
+		} {
+			// 直接调用处理函数，不经过 ServeMux 的路径清理
+			req := httptest.NewRequest("GET", prefix+rest, nil)
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("GET %s%s: status %d, want 403", prefix, rest, rec.Code)
+			}
+			if strings.Contains(rec.Body.String(), "top secret") {
+				t.Errorf("GET %s%s leaked the secret", prefix, rest)
+			}
+		}
+	}
+}
+
+func TestDefaultFileRootsHomeReadOnly(t *testing.T) {
+	setupRoots(t)
+	t.Setenv("HOME", t.TempDir())
+	for _, fr := range defaultFileRoots() {
+		if fr.Name == "home" && fr.Write {
+			t.Error("home root is writable by default")
+		}
+	}
+}
+
+func TestFileAPIHeadOnReadOnlyRoot(t *testing.T) {
+	ws := setupRoots(t)
+	writeTestFile(t, filepath.Join(ws, "notes.txt"), "hello")
+	portalConfig.FileRoots[0].Write = false
+
+	for prefix, h := range map[string]http.HandlerFunc{
+		"/portal/api/file/":  handleFileAPI,
+		"/portal/api/files/": handleFilesAPI,
+	} {
+		target := prefix + "workspace:"
+		if prefix == "/portal/api/file/" {
+			target += "notes.txt"
+		}
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("HEAD", target, nil))
+		if rec.Code == http.StatusForbidden {
+			t.Errorf("HEAD %s on a read-only root: status 403", target)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== Login Sessions ==============
+
+// Session is the server-side record behind a portal_token cookie. The cookie
+// value itself is never stored; sessions are keyed by its SHA-256 hash.
+type Session struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Role      Role      `json:"role,omitempty"` // only for identities from an external provider (OIDC)
+}
+
+type SessionStore struct {
+	mu          sync.Mutex
+	path        string
+	sessions    map[string]*Session
+	dirty       bool
+	idleTimeout time.Duration
+	maxAge      time.Duration
+}
+
+var sessions *SessionStore
+
+// lastSeenGranularity limits how often LastSeen is bumped (and the file rewritten).
+const lastSeenGranularity = time.Minute
+
+func loadSessionStore(path string, idleTimeout, maxAge time.Duration) (*SessionStore, error) {
+	s := &SessionStore{
+		path:        path,
+		sessions:    make(map[string]*Session),
+		idleTimeout: idleTimeout,
+		maxAge:      maxAge,
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var list []*Session
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for _, sess := range list {
+			if !s.expired(sess, now) {
+				s.sessions[sess.ID] = sess
+			}
+		}
+	}
+	go s.maintain()
+	return s, nil
+}
+
+func sessionID(cookieValue string) string {
+	sum := sha256.Sum256([]byte(cookieValue))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *SessionStore) expired(sess *Session, now time.Time) bool {
+	if s.maxAge > 0 && now.Sub(sess.CreatedAt) > s.maxAge {
+		return true
+	}
+	if s.idleTimeout > 0 && now.Sub(sess.LastSeen) > s.idleTimeout {
+		return true
+	}
+	return false
+}
+
+// save must be called with s.mu held.
+func (s *SessionStore) save() {
+	list := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		list = append(list, sess)
+	}
+	if err := writeJSONFile(s.path, list); err != nil {
+		log.Printf("Failed to save sessions: %v", err)
+		return
+	}
+	s.dirty = false
+}
+
+// maintain prunes expired sessions and flushes LastSeen updates to disk.
+func (s *SessionStore) maintain() {
+	for range time.Tick(lastSeenGranularity) {
+		s.mu.Lock()
+		now := time.Now()
+		for id, sess := range s.sessions {
+			if s.expired(sess, now) {
+				delete(s.sessions, id)
+				s.dirty = true
+			}
+		}
+		if s.dirty {
+			s.save()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Create starts a session for username and returns the cookie value to hand out.
+// role is only set for external identities that have no local account.
+func (s *SessionStore) Create(username string, role Role, r *http.Request) (string, *Session) {
+	cookieValue := generateToken() + generateToken()
+	now := time.Now().UTC()
+	sess := &Session{
+		ID:        sessionID(cookieValue),
+		Username:  username,
+		CreatedAt: now,
+		LastSeen:  now,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Role:      role,
+	}
+	s.mu.Lock()
+	s.sessions[sess.ID] = sess
+	s.save()
+	s.mu.Unlock()
+	return cookieValue, sess
+}
+
+// Touch looks up the session for a cookie value and records activity on it.
+func (s *SessionStore) Touch(cookieValue string, r *http.Request) (*Session, bool) {
+	id := sessionID(cookieValue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now().UTC()
+	if s.expired(sess, now) {
+		delete(s.sessions, id)
+		s.dirty = true
+		return nil, false
+	}
+	if now.Sub(sess.LastSeen) >= lastSeenGranularity {
+		sess.LastSeen = now
+		sess.IP = clientIP(r)
+		s.dirty = true
+	}
+	copied := *sess
+	return &copied, true
+}
+
+func (s *SessionStore) Get(id string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *sess
+	return &copied, true
+}
+
+// List returns the sessions of username, or of everyone if username is empty.
+func (s *SessionStore) List(username string) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Session, 0, len(s.sessions))
+	now := time.Now()
+	for _, sess := range s.sessions {
+		if s.expired(sess, now) || (username != "" && sess.Username != username) {
+			continue
+		}
+		list = append(list, *sess)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+func (s *SessionStore) Revoke(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return false
+	}
+	delete(s.sessions, id)
+	s.save()
+	return true
+}
+
+// RevokeUser removes every session of username except keepID and returns how many were removed.
+func (s *SessionStore) RevokeUser(username, keepID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, sess := range s.sessions {
+		if sess.Username == username && id != keepID {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	if n > 0 {
+		s.save()
+	}
+	return n
+}
+
+// remoteIP returns the host part of r.RemoteAddr.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ============== Sessions API ==============
+
+// handleSessionsAPI lists and revokes login sessions. Admins see every
+// session; other users only their own.
+func handleSessionsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p := principalFrom(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/sessions"), "/")
+
+	owner := p.Username
+	if p.Role == RoleAdmin {
+		owner = ""
+	}
+
+	switch {
+	case r.Method == "GET" && id == "":
+		list := sessions.List(owner)
+		out := make([]map[string]interface{}, 0, len(list))
+		for _, sess := range list {
+			out = append(out, map[string]interface{}{
+				"id":         sess.ID,
+				"username":   sess.Username,
+				"created_at": sess.CreatedAt.Format(time.RFC3339),
+				"last_seen":  sess.LastSeen.Format(time.RFC3339),
+				"ip":         sess.IP,
+				"user_agent": sess.UserAgent,
+				"current":    sess.ID == p.SessionID,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"sessions": out})
+
+	case r.Method == "DELETE" && id == "":
+		// 注销当前用户的其他所有会话
+		n := sessions.RevokeUser(p.Username, p.SessionID)
+		audit(r, "sessions.revoke", "all other sessions", nil)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "revoked": n})
+
+	case r.Method == "DELETE":
+		sess, ok := sessions.Get(id)
+		if !ok || (owner != "" && sess.Username != owner) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		sessions.Revoke(id)
+		audit(r, "sessions.revoke", sess.Username+" "+id[:12], nil)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
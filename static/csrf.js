@@ -0,0 +1,13 @@
+// 为非 GET 请求附加 CSRF token (double-submit cookie)
+(function () {
+    const originalFetch = window.fetch;
+    window.fetch = (input, init = {}) => {
+        const method = (init.method || (input instanceof Request ? input.method : 'GET')).toUpperCase();
+        if (method !== 'GET' && method !== 'HEAD') {
+            const match = document.cookie.match(/(?:^|;\s*)portal_csrf=([^;]*)/);
+            init.headers = new Headers(init.headers || {});
+            if (match) init.headers.set('X-CSRF-Token', decodeURIComponent(match[1]));
+        }
+        return originalFetch(input, init);
+    };
+})();
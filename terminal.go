@@ -0,0 +1,1055 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// ============== Persistent Terminal Sessions ==============
+
+// TermSession is a shell running under a PTY in the portal process. It keeps
+// running when its WebSocket drops; a client that reconnects with the
+// session ID gets the recent output replayed and continues where it left off.
+// Any number of clients may be attached; output goes to all of them, input is
+// only accepted from read-write clients.
+type TermSession struct {
+	ID        string
+	Owner     string
+	Shell     string
+	Profile   string
+	StartedAt time.Time
+
+	cmd           *exec.Cmd
+	ptmx          *os.File
+	done          chan struct{} // closed once the shell has exited
+	orphanTimeout time.Duration
+	rec           *castRecorder // nil when the session is not recorded
+	cgroup        *procCgroup   // nil when resource limits are not in use
+
+	mu          sync.Mutex
+	name        string
+	share       string // mode other users may attach with: "", termModeRO or termModeRW
+	scrollback  *ringBuffer
+	clients     map[*termClient]struct{}
+	rows, cols  int
+	orphanTimer *time.Timer
+	exitCode    int
+	lastInput   time.Time // last keystroke from a read-write client
+	idleWarned  bool
+	idleReaped  bool
+	transfers   map[string]*termTransfer // pending portal-send/portal-recv requests
+
+	transferToken string // $PORTAL_TRANSFER_TOKEN of the shell
+	oscCarry      []byte // unfinished transfer sequence; pump only
+}
+
+// Attachment modes.
+const (
+	termModeRW = "rw"
+	termModeRO = "ro"
+)
+
+// TermRegistry holds the live terminal sessions.
+type TermRegistry struct {
+	mu            sync.Mutex
+	sessions      map[string]*TermSession
+	orphanTimeout time.Duration // how long a session survives without a client
+	scrollback    int           // bytes of output kept for replay
+	idleTimeout   time.Duration // 0: sessions never go idle
+	idleWarning   time.Duration // how long before the idle timeout clients are warned
+	idleKill      bool          // kill idle sessions instead of detaching their clients
+}
+
+// termStats counts how terminal sessions and connections ended.
+var termStats struct {
+	started         atomic.Int64
+	closed          atomic.Int64
+	orphaned        atomic.Int64 // killed after the orphan timeout
+	idleDetached    atomic.Int64 // clients detached by the idle timeout, per session
+	idleKilled      atomic.Int64
+	deadConnections atomic.Int64 // WebSockets that stopped answering pings
+}
+
+// termPingInterval is how often clients are pinged; a client that has not
+// answered for two intervals is disconnected. 0 disables pings.
+var termPingInterval = 30 * time.Second
+
+var terminals *TermRegistry
+
+func newTermRegistry(orphanTimeout time.Duration, scrollback int) *TermRegistry {
+	return &TermRegistry{
+		sessions:      make(map[string]*TermSession),
+		orphanTimeout: orphanTimeout,
+		scrollback:    scrollback,
+	}
+}
+
+// Get returns the session with id if p may manage it (owner or admin).
+func (t *TermRegistry) Get(id string, p *Principal) *TermSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sessions[id]
+	if !ok || (s.Owner != p.Username && p.Role != RoleAdmin) {
+		return nil
+	}
+	return s
+}
+
+// Open returns the session with id and the most p may attach with: read-write
+// for the owner and admins, the share mode for everyone else.
+func (t *TermRegistry) Open(id string, p *Principal) (*TermSession, string) {
+	t.mu.Lock()
+	s, ok := t.sessions[id]
+	t.mu.Unlock()
+	if !ok {
+		return nil, ""
+	}
+	if s.Owner == p.Username || p.Role == RoleAdmin {
+		return s, termModeRW
+	}
+	s.mu.Lock()
+	mode := s.share
+	s.mu.Unlock()
+	if mode == "" {
+		return nil, ""
+	}
+	return s, mode
+}
+
+// List returns the sessions p may manage or attach to, oldest first.
+func (t *TermRegistry) List(p *Principal) []*TermSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*TermSession, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		s.mu.Lock()
+		shared := s.share != ""
+		s.mu.Unlock()
+		if s.Owner == p.Username || p.Role == RoleAdmin || shared {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// termOptions describe the shell to start. Empty fields use the defaults.
+type termOptions struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"`
+	Shell   string `json:"shell"` // overrides the profile's shell and args
+	Cwd     string `json:"cwd"`
+	Record  *bool  `json:"record"` // nil: PORTAL_TERMINAL_RECORD decides; see startTerminal
+}
+
+// Start spawns a new shell for owner. Until a client attaches, the session is
+// subject to the orphan timeout like a detached one.
+func (t *TermRegistry) Start(owner string, opts termOptions, onExit func(*TermSession)) (*TermSession, error) {
+	profile, err := terminalProfile(opts.Profile)
+	if err != nil {
+		return nil, err
+	}
+	shell, args := profile.Shell, profile.Args
+	if opts.Shell != "" {
+		shell, args = opts.Shell, nil
+	}
+	if shell == "" {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+	if _, err := exec.LookPath(shell); err != nil {
+		return nil, err
+	}
+	cwd := profile.dir()
+	if opts.Cwd != "" {
+		cwd = opts.Cwd
+	}
+	if info, err := os.Stat(cwd); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", cwd)
+	}
+
+	cmd := exec.Command(shell, args...)
+	if profile.Login {
+		// 与 login(1) 相同，argv[0] 以 "-" 开头表示登录 shell
+		cmd.Args[0] = "-" + filepath.Base(shell)
+	}
+	id, transferToken := generateToken(), generateToken()
+	cmd.Env = transferEnv(profile.environ(), id, transferToken)
+	cmd.Dir = cwd
+
+	cg, err := cgroups.New("term-" + id)
+	if err == nil {
+		err = cg.Apply(cmd)
+	}
+	if err != nil {
+		// 与录像一样，资源限制失败不影响终端使用
+		log.Printf("Failed to create cgroup for terminal session %s: %v", id, err)
+		cg.Remove()
+		cg = nil
+	}
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: 24, Cols: 80})
+	cg.Started()
+	if err != nil {
+		cg.Remove()
+		return nil, err
+	}
+
+	name := strings.TrimSpace(opts.Name)
+	if name == "" {
+		name = profile.Name
+	}
+	if name == "" || name == "default" {
+		name = filepath.Base(shell)
+	}
+	s := &TermSession{
+		ID:            id,
+		Owner:         owner,
+		Shell:         shell,
+		Profile:       profile.Name,
+		StartedAt:     time.Now().UTC(),
+		cmd:           cmd,
+		ptmx:          ptmx,
+		cgroup:        cg,
+		done:          make(chan struct{}),
+		orphanTimeout: t.orphanTimeout,
+		name:          name,
+		scrollback:    newRingBuffer(t.scrollback),
+		clients:       make(map[*termClient]struct{}),
+		rows:          24,
+		cols:          80,
+		lastInput:     time.Now(),
+		transferToken: transferToken,
+		transfers:     make(map[string]*termTransfer),
+	}
+	record := recordings.all
+	if opts.Record != nil {
+		record = *opts.Record
+	}
+	if record {
+		// 录制失败不影响终端使用
+		if s.rec, err = recordings.Start(s, s.rows, s.cols); err != nil {
+			log.Printf("Failed to record terminal session %s: %v", s.ID, err)
+		}
+	}
+	t.mu.Lock()
+	t.sessions[s.ID] = s
+	t.mu.Unlock()
+	termStats.started.Add(1)
+
+	s.mu.Lock()
+	s.armOrphanTimer()
+	s.mu.Unlock()
+
+	go func() {
+		s.pump()
+		t.mu.Lock()
+		delete(t.sessions, s.ID)
+		t.mu.Unlock()
+		if onExit != nil {
+			onExit(s)
+		}
+	}()
+	return s, nil
+}
+
+// pump copies PTY output to the scrollback and the attached clients until
+// the shell exits.
+func (s *TermSession) pump() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.ptmx.Read(buf)
+		var data []byte
+		if n > 0 {
+			data = s.filterTransfers(append([]byte(nil), buf[:n]...))
+		}
+		if len(data) > 0 {
+			s.waitForCredit()
+			s.mu.Lock()
+			s.scrollback.Write(data)
+			if s.rec != nil {
+				s.rec.Output(data)
+			}
+			for c := range s.clients {
+				c.spend(len(data))
+				c.enqueue(wsFrame{websocket.BinaryMessage, data})
+			}
+			s.mu.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	code, signal := 0, ""
+	if err := s.cmd.Wait(); err != nil {
+		code = -1
+		if ee, ok := err.(*exec.ExitError); ok {
+			code = ee.ExitCode()
+			if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				signal = signalName(ws.Signal())
+			}
+		}
+	}
+	s.ptmx.Close()
+	if s.rec != nil {
+		s.rec.Close()
+	}
+	s.cgroup.Remove()
+
+	s.mu.Lock()
+	s.exitCode = code
+	if s.orphanTimer != nil {
+		s.orphanTimer.Stop()
+	}
+	for c := range s.clients {
+		exit := map[string]interface{}{"type": "exit", "code": code}
+		if signal != "" {
+			exit["signal"] = signal
+		}
+		c.control(exit)
+		c.finish()
+		delete(s.clients, c)
+	}
+	s.mu.Unlock()
+	close(s.done)
+	termStats.closed.Add(1)
+}
+
+// Attach adds c to the session, replaying the scrollback first.
+func (s *TermSession) Attach(c *termClient, isNew bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.orphanTimer != nil {
+		s.orphanTimer.Stop()
+		s.orphanTimer = nil
+	}
+	// 重新连接也算作活动，避免刚连上就因空闲被断开
+	s.lastInput = time.Now()
+	s.idleWarned = false
+	hello := map[string]interface{}{"type": "session", "id": s.ID, "new": isNew, "mode": c.mode, "protocol": 2}
+	if c.flow {
+		hello["window"] = termCreditWindow
+	}
+	c.control(hello)
+	if replay := s.scrollback.Bytes(); len(replay) > 0 {
+		c.spend(len(replay))
+		c.enqueue(wsFrame{websocket.BinaryMessage, replay})
+	}
+	s.clients[c] = struct{}{}
+}
+
+// Detach removes c and, if nobody else is attached, starts the orphan timer.
+func (s *TermSession) Detach(c *termClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+	delete(s.clients, c)
+	if len(s.clients) == 0 {
+		s.armOrphanTimer()
+		return
+	}
+	s.applySize()
+}
+
+// Input writes keystrokes from c to the PTY. Input from read-only clients is
+// dropped.
+func (s *TermSession) Input(c *termClient, data []byte) {
+	if c.mode != termModeRW {
+		return
+	}
+	s.mu.Lock()
+	s.lastInput = time.Now()
+	s.idleWarned = false
+	s.mu.Unlock()
+	if s.rec != nil {
+		s.rec.Input(data)
+	}
+	s.ptmx.Write(data)
+}
+
+// ClientResize records the size of c's terminal. The PTY follows the smallest
+// read-write client so that every writer sees the whole screen; read-only
+// clients never change the size.
+func (s *TermSession) ClientResize(c *termClient, rows, cols int) {
+	if c.mode != termModeRW || rows <= 0 || cols <= 0 || rows > 1000 || cols > 1000 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.rows, c.cols = rows, cols
+	s.applySize()
+}
+
+// applySize must be called with s.mu held.
+func (s *TermSession) applySize() {
+	rows, cols := 0, 0
+	for c := range s.clients {
+		if c.mode != termModeRW || c.rows == 0 {
+			continue
+		}
+		if rows == 0 || c.rows < rows {
+			rows = c.rows
+		}
+		if cols == 0 || c.cols < cols {
+			cols = c.cols
+		}
+	}
+	if rows == 0 || (rows == s.rows && cols == s.cols) {
+		return
+	}
+	s.rows, s.cols = rows, cols
+	pty.Setsize(s.ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+	if s.rec != nil {
+		s.rec.Resize(rows, cols)
+	}
+}
+
+// armOrphanTimer kills the session once it has had no client for
+// orphanTimeout. It must be called with s.mu held.
+func (s *TermSession) armOrphanTimer() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	if s.orphanTimer != nil {
+		s.orphanTimer.Stop()
+	}
+	if s.orphanTimeout <= 0 {
+		go s.Kill()
+		return
+	}
+	s.orphanTimer = time.AfterFunc(s.orphanTimeout, func() {
+		s.mu.Lock()
+		orphaned := len(s.clients) == 0
+		s.mu.Unlock()
+		if orphaned {
+			log.Printf("Terminal session %s orphaned for %s, killing", s.ID, s.orphanTimeout)
+			termStats.orphaned.Add(1)
+			s.Kill()
+		}
+	})
+}
+
+// StartIdleReaper warns the clients of sessions without input for
+// timeout-warning, and at timeout detaches them (or kills the session when
+// kill is set). Detached sessions are then subject to the orphan timeout.
+func (t *TermRegistry) StartIdleReaper(timeout, warning time.Duration, kill bool) {
+	if timeout <= 0 {
+		return
+	}
+	if warning >= timeout {
+		warning = timeout / 2
+	}
+	t.idleTimeout, t.idleWarning, t.idleKill = timeout, warning, kill
+	tick := 5 * time.Second
+	if warning > 0 && warning/4 < tick {
+		tick = max(warning/4, 100*time.Millisecond)
+	}
+	go func() {
+		for range time.Tick(tick) {
+			t.mu.Lock()
+			list := make([]*TermSession, 0, len(t.sessions))
+			for _, s := range t.sessions {
+				list = append(list, s)
+			}
+			t.mu.Unlock()
+			for _, s := range list {
+				t.checkIdle(s)
+			}
+		}
+	}()
+}
+
+func (t *TermRegistry) checkIdle(s *TermSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idle := time.Since(s.lastInput)
+	action := "detach"
+	if t.idleKill {
+		action = "kill"
+	}
+	switch {
+	case s.idleReaped:
+	case idle >= t.idleTimeout && t.idleKill:
+		log.Printf("Terminal session %s idle for %s, killing", s.ID, idle.Round(time.Second))
+		s.idleReaped = true
+		termStats.idleKilled.Add(1)
+		for c := range s.clients {
+			c.control(map[string]interface{}{"type": "idle", "action": action})
+		}
+		go s.Kill()
+	case idle >= t.idleTimeout && len(s.clients) > 0:
+		log.Printf("Terminal session %s idle for %s, detaching %d client(s)", s.ID, idle.Round(time.Second), len(s.clients))
+		termStats.idleDetached.Add(1)
+		for c := range s.clients {
+			c.control(map[string]interface{}{"type": "idle", "action": action})
+			c.finish()
+			delete(s.clients, c)
+		}
+		s.armOrphanTimer()
+	case idle >= t.idleTimeout-t.idleWarning && !s.idleWarned && len(s.clients) > 0:
+		s.idleWarned = true
+		remaining := int((t.idleTimeout - idle).Seconds())
+		for c := range s.clients {
+			c.control(map[string]interface{}{"type": "idle_warning", "action": action, "remaining": remaining})
+		}
+	}
+}
+
+// Kill hangs up the shell's process group and forcibly kills it if it has not
+// exited a few seconds later.
+func (s *TermSession) Kill() {
+	pid := s.cmd.Process.Pid
+	syscall.Kill(-pid, syscall.SIGHUP)
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		syscall.Kill(-pid, syscall.SIGKILL)
+		s.cgroup.Kill()
+	}
+}
+
+// Signal sends sig to the foreground process group of the terminal, like
+// typing Ctrl-C would for SIGINT. It falls back to the shell's own group.
+func (s *TermSession) Signal(sig syscall.Signal) error {
+	pgrp := s.cmd.Process.Pid
+	var fg int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, s.ptmx.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&fg))); errno == 0 && fg > 0 {
+		pgrp = int(fg)
+	}
+	return syscall.Kill(-pgrp, sig)
+}
+
+func (s *TermSession) Name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+func (s *TermSession) Rename(name string) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetShare sets the mode other users may attach with ("" stops sharing).
+// Clients that are already attached keep their mode.
+func (s *TermSession) SetShare(mode string) {
+	s.mu.Lock()
+	s.share = mode
+	s.mu.Unlock()
+}
+
+// TermSessionInfo is the API view of a session.
+type TermSessionInfo struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Owner     string           `json:"owner"`
+	Shell     string           `json:"shell"`
+	Profile   string           `json:"profile,omitempty"`
+	PID       int              `json:"pid"`
+	Cwd       string           `json:"cwd"`
+	StartedAt time.Time        `json:"started_at"`
+	Share     string           `json:"share"`
+	Recording bool             `json:"recording"`
+	Resources *CgroupUsage     `json:"resources,omitempty"`
+	Clients   int              `json:"clients"`
+	Attached  []TermClientInfo `json:"attached"`
+}
+
+type TermClientInfo struct {
+	User  string    `json:"user"`
+	Mode  string    `json:"mode"`
+	IP    string    `json:"ip"`
+	Since time.Time `json:"since"`
+}
+
+func (s *TermSession) Info() TermSessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := TermSessionInfo{
+		ID:        s.ID,
+		Name:      s.name,
+		Owner:     s.Owner,
+		Shell:     s.Shell,
+		Profile:   s.Profile,
+		PID:       s.cmd.Process.Pid,
+		StartedAt: s.StartedAt,
+		Share:     s.share,
+		Recording: s.rec != nil,
+		Resources: s.cgroup.Usage(),
+		Clients:   len(s.clients),
+		Attached:  []TermClientInfo{},
+	}
+	// 读取 shell 当前所在目录
+	info.Cwd, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", info.PID))
+	for c := range s.clients {
+		info.Attached = append(info.Attached, TermClientInfo{User: c.user, Mode: c.mode, IP: c.ip, Since: c.since})
+	}
+	sort.Slice(info.Attached, func(i, j int) bool { return info.Attached[i].Since.Before(info.Attached[j].Since) })
+	return info
+}
+
+// ============== Terminal Clients ==============
+
+type wsFrame struct {
+	typ  int
+	data []byte
+}
+
+// termClient is one WebSocket attached to a session. All writes go through
+// send so that only writeLoop touches the connection.
+type termClient struct {
+	conn      *websocket.Conn
+	user      string
+	mode      string
+	ip        string
+	since     time.Time
+	send      chan wsFrame
+	closed    chan struct{}
+	closeOnce sync.Once
+	v2        bool // speaks termProtocolV2
+	flow      bool // read-write v2 client: output is credit-based
+
+	rows, cols int // last size reported by the client, guarded by the session's mu
+
+	creditMu sync.Mutex
+	credit   int
+	creditC  chan struct{} // signalled when credit is added
+}
+
+func newTermClient(conn *websocket.Conn, user, mode, ip string) *termClient {
+	v2 := conn.Subprotocol() == termProtocolV2
+	return &termClient{
+		conn:    conn,
+		user:    user,
+		mode:    mode,
+		ip:      ip,
+		since:   time.Now().UTC(),
+		send:    make(chan wsFrame, 256),
+		closed:  make(chan struct{}),
+		v2:      v2,
+		flow:    v2 && mode == termModeRW,
+		credit:  termCreditWindow,
+		creditC: make(chan struct{}, 1),
+	}
+}
+
+// enqueue queues a frame. A client that cannot keep up is disconnected; it
+// will catch up from the scrollback when it reattaches.
+func (c *termClient) enqueue(f wsFrame) {
+	select {
+	case <-c.closed:
+	case c.send <- f:
+	default:
+		c.close()
+	}
+}
+
+// control queues a JSON control message as a text frame; terminal output is
+// always sent as binary frames. Legacy clients would show control messages
+// as output, so they get none.
+func (c *termClient) control(v interface{}) {
+	if !c.v2 {
+		return
+	}
+	data, _ := json.Marshal(v)
+	c.enqueue(wsFrame{websocket.TextMessage, data})
+}
+
+// finish closes the connection after the queued frames have been written.
+func (c *termClient) finish() {
+	c.enqueue(wsFrame{websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")})
+}
+
+func (c *termClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// writeLoop writes queued frames and pings the client every termPingInterval.
+func (c *termClient) writeLoop() {
+	var ping <-chan time.Time
+	if termPingInterval > 0 {
+		ticker := time.NewTicker(termPingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ping:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				c.close()
+				return
+			}
+		case f := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(f.typ, f.data); err != nil || f.typ == websocket.CloseMessage {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// ============== Terminal WebSocket ==============
+
+// handleTerminalWS attaches to the session given by ?session=<id>, or starts
+// a new one (from ?profile=<name>) when no ID is given. A session that has
+// ended or is not shared with the user closes the connection with
+// termCloseNotFound rather than silently starting a new shell. ?mode=ro
+// attaches as a read-only spectator; users other than the owner get at most
+// the mode the session is shared with. For v2 clients the first message is
+// {"type":"session","id":...,"mode":...} so the page can reconnect. See
+// termproto.go for the framing.
+func handleTerminalWS(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r)
+	q := r.URL.Query()
+	mode := q.Get("mode")
+	if mode != termModeRO {
+		mode = termModeRW
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+
+	sess, allowed := terminals.Open(q.Get("session"), p)
+	if sess == nil && q.Get("session") != "" {
+		msg := websocket.FormatCloseMessage(termCloseNotFound, "session not found")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	isNew := sess == nil
+	if isNew {
+		opts := termOptions{Profile: q.Get("profile")}
+		if v := q.Get("record"); v != "" {
+			record := v == "1" || v == "true"
+			opts.Record = &record
+		}
+		sess, err = startTerminal(r, opts)
+		if err != nil {
+			log.Printf("PTY start error: %v", err)
+			conn.Close()
+			return
+		}
+		mode = termModeRW
+	} else {
+		if allowed == termModeRO {
+			mode = termModeRO
+		}
+		audit(r, "terminal.attach", "session "+sess.ID+" ("+mode+")", nil)
+	}
+
+	client := newTermClient(conn, p.Username, mode, clientIP(r))
+	go client.writeLoop()
+	sess.Attach(client, isNew)
+	defer sess.Detach(client)
+	defer client.close()
+
+	// 收不到 pong 的连接 (如 NAT 后的半开连接) 在两个 ping 周期后断开
+	extendDeadline := func() {
+		if termPingInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * termPingInterval))
+		}
+	}
+	extendDeadline()
+	conn.SetPongHandler(func(string) error {
+		extendDeadline()
+		return nil
+	})
+
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				log.Printf("Terminal client %s@%s of session %s stopped responding, disconnecting", client.user, client.ip, sess.ID)
+				termStats.deadConnections.Add(1)
+			}
+			return
+		}
+		extendDeadline()
+		if client.v2 {
+			if typ == websocket.BinaryMessage {
+				sess.Input(client, msg)
+			} else {
+				sess.Control(client, msg)
+			}
+			continue
+		}
+		// 旧协议：能解析为 resize 的 JSON 是控制消息，其余都是输入
+		if len(msg) > 0 && msg[0] == '{' {
+			var resize struct {
+				Type string `json:"type"`
+				Cols int    `json:"cols"`
+				Rows int    `json:"rows"`
+			}
+			if json.Unmarshal(msg, &resize) == nil && resize.Type == "resize" {
+				sess.ClientResize(client, resize.Rows, resize.Cols)
+				continue
+			}
+		}
+		sess.Input(client, msg)
+	}
+}
+
+// startTerminal starts a shell for the caller of r and audits its lifetime.
+// When PORTAL_TERMINAL_RECORD records every session, only admins may opt a
+// session out; everyone else can only turn recording on.
+func startTerminal(r *http.Request, opts termOptions) (*TermSession, error) {
+	if opts.Record != nil && !*opts.Record && recordings.all && !principalFrom(r).Role.allows(RoleAdmin) {
+		opts.Record = nil
+	}
+	sess, err := terminals.Start(principalFrom(r).Username, opts, func(s *TermSession) {
+		audit(r, "terminal.close", s.Shell+" (session "+s.ID+", exit "+strconv.Itoa(s.exitCode)+")", nil)
+	})
+	if err != nil {
+		audit(r, "terminal.open", opts.Shell, err)
+		return nil, err
+	}
+	audit(r, "terminal.open", sess.Shell+" (session "+sess.ID+")", nil)
+	return sess, nil
+}
+
+// ============== Terminal Sessions API ==============
+
+// handleTerminalStatsAPI reports live sessions and how past sessions and
+// connections were reaped:
+//
+//	GET /portal/api/terminal/stats
+func handleTerminalStatsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	terminals.mu.Lock()
+	active, clients := len(terminals.sessions), 0
+	for _, s := range terminals.sessions {
+		s.mu.Lock()
+		clients += len(s.clients)
+		s.mu.Unlock()
+	}
+	terminals.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active_sessions":  active,
+		"attached_clients": clients,
+		"started":          termStats.started.Load(),
+		"closed":           termStats.closed.Load(),
+		"reaped": map[string]int64{
+			"orphaned":         termStats.orphaned.Load(),
+			"idle_detached":    termStats.idleDetached.Load(),
+			"idle_killed":      termStats.idleKilled.Load(),
+			"dead_connections": termStats.deadConnections.Load(),
+		},
+	})
+}
+
+// terminalSignals are the signals the API and the page may send.
+var terminalSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"STOP":  syscall.SIGSTOP,
+	"CONT":  syscall.SIGCONT,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+func parseSignal(name string) (syscall.Signal, bool) {
+	sig, ok := terminalSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	return sig, ok
+}
+
+// signalName returns the short name of sig, e.g. "KILL".
+func signalName(sig syscall.Signal) string {
+	for name, s := range terminalSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// handleTerminalSessionsAPI manages terminal sessions:
+//
+//	GET    /portal/api/terminal/sessions            list
+//	POST   /portal/api/terminal/sessions            create {name, profile, shell, cwd, record}
+//	PUT    /portal/api/terminal/sessions/<id>       update {name, share: "ro"|"rw"|""}
+//	POST   /portal/api/terminal/sessions/<id>/signal {signal: "INT"}
+//	DELETE /portal/api/terminal/sessions/<id>       kill
+//
+// and the transfers started by portal-send and portal-recv (see handleTransfer).
+func handleTerminalSessionsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p := principalFrom(r)
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/terminal/sessions"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	var sess *TermSession
+	if id != "" {
+		if sess = terminals.Get(id, p); sess == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if tid, ok := strings.CutPrefix(action, "transfers/"); ok {
+		handleTransfer(w, r, sess, tid)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && id == "":
+		list := []TermSessionInfo{}
+		for _, s := range terminals.List(p) {
+			list = append(list, s.Info())
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"sessions": list})
+
+	case r.Method == "GET" && action == "":
+		json.NewEncoder(w).Encode(sess.Info())
+
+	case r.Method == "POST" && id == "":
+		var opts termOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		s, err := startTerminal(r, opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(s.Info())
+
+	case r.Method == "PUT" && action == "":
+		var req struct {
+			Name  *string `json:"name"`
+			Share *string `json:"share"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var name string
+		if req.Name != nil {
+			if name = strings.TrimSpace(*req.Name); name == "" {
+				http.Error(w, "Name is required", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Share != nil {
+			switch *req.Share {
+			case "", "none", termModeRO, termModeRW:
+			default:
+				http.Error(w, "Invalid share mode", http.StatusBadRequest)
+				return
+			}
+		}
+		if name != "" {
+			audit(r, "terminal.rename", "session "+sess.ID+" -> "+name, nil)
+			sess.Rename(name)
+		}
+		if req.Share != nil {
+			share := strings.TrimPrefix(*req.Share, "none")
+			target := share
+			if target == "" {
+				target = "none"
+			}
+			audit(r, "terminal.share", "session "+sess.ID+" ("+target+")", nil)
+			sess.SetShare(share)
+		}
+		json.NewEncoder(w).Encode(sess.Info())
+
+	case r.Method == "POST" && action == "signal":
+		var req struct {
+			Signal string `json:"signal"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		sig, ok := parseSignal(req.Signal)
+		if !ok {
+			http.Error(w, "Unknown signal", http.StatusBadRequest)
+			return
+		}
+		err := sess.Signal(sig)
+		audit(r, "terminal.signal", "session "+sess.ID+" SIG"+strings.TrimPrefix(strings.ToUpper(req.Signal), "SIG"), err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+	case r.Method == "DELETE" && action == "":
+		audit(r, "terminal.kill", "session "+sess.ID, nil)
+		go sess.Kill()
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ============== Ring Buffer ==============
+
+// ringBuffer keeps the last size bytes written to it.
+type ringBuffer struct {
+	buf  []byte
+	size int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	if b.size <= 0 {
+		return
+	}
+	b.buf = append(b.buf, p...)
+	// 超过两倍容量时才压缩，避免每次写入都复制
+	if len(b.buf) > 2*b.size {
+		b.buf = append([]byte(nil), b.buf[len(b.buf)-b.size:]...)
+	}
+}
+
+// Bytes returns a copy of the last size bytes.
+func (b *ringBuffer) Bytes() []byte {
+	data := b.buf
+	if len(data) > b.size {
+		data = data[len(data)-b.size:]
+	}
+	return append([]byte(nil), data...)
+}
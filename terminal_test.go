@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// terminalTestServer serves handleTerminalWS; the user is taken from the
+// ?user= query parameter.
+func terminalTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	oldTerminals, oldRecordings, oldBase := terminals, recordings, baseDir
+	t.Cleanup(func() { terminals, recordings, baseDir = oldTerminals, oldRecordings, oldBase })
+	terminals = newTermRegistry(time.Minute, 64<<10)
+	recordings = &RecordingStore{}
+	baseDir = t.TempDir()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &Principal{Username: r.URL.Query().Get("user"), Role: RoleDeveloper}
+		handleTerminalWS(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dialTerminal connects to srv like the terminal page does, speaking
+// termProtocolV2 unless other subprotocols are given.
+func dialTerminal(t *testing.T, srv *httptest.Server, query string, protocols ...string) *websocket.Conn {
+	t.Helper()
+	if protocols == nil {
+		protocols = []string{termProtocolV2}
+	}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/portal/ws/terminal?" + query
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestTerminalWSSessionNotFound(t *testing.T) {
+	srv := terminalTestServer(t)
+
+	// 新会话：第一条消息给出会话 ID
+	conn := dialTerminal(t, srv, "user=bob")
+	var first struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	if err := conn.ReadJSON(&first); err != nil || first.Type != "session" {
+		t.Fatalf("first message %+v, %v", first, err)
+	}
+	if sess := terminals.Get(first.ID, &Principal{Username: "bob"}); sess != nil {
+		defer sess.Kill()
+	}
+
+	for _, query := range []string{
+		"user=alice&session=" + generateToken(), // 不存在
+		"user=alice&session=" + first.ID,        // 未共享给 alice
+	} {
+		_, _, err := dialTerminal(t, srv, query).ReadMessage()
+		if !websocket.IsCloseError(err, termCloseNotFound) {
+			t.Errorf("%s: read error = %v, want close %d", query, err, termCloseNotFound)
+		}
+	}
+	if n := len(terminals.List(&Principal{Username: "admin", Role: RoleAdmin})); n != 1 {
+		t.Errorf("%d sessions, want only bob's", n)
+	}
+}
+
+func TestRecordingOptOutNeedsAdmin(t *testing.T) {
+	oldTerminals, oldRecordings, oldBase := terminals, recordings, baseDir
+	t.Cleanup(func() { terminals, recordings, baseDir = oldTerminals, oldRecordings, oldBase })
+	terminals = newTermRegistry(time.Minute, 64<<10)
+	baseDir = t.TempDir()
+
+	off, on := false, true
+	tests := []struct {
+		all    bool
+		role   Role
+		record *bool
+		want   bool
+	}{
+		{true, RoleDeveloper, nil, true},
+		{true, RoleDeveloper, &off, true}, // 被审计的用户不能关闭自己的录制
+		{true, RoleAdmin, &off, false},
+		{false, RoleDeveloper, &on, true},
+		{false, RoleDeveloper, &off, false},
+		{false, RoleDeveloper, nil, false},
+	}
+	for _, tt := range tests {
+		var err error
+		if recordings, err = newRecordingStore(t.TempDir(), tt.all, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		p := &Principal{Username: "alice", Role: tt.role}
+		r := httptest.NewRequest("GET", "/portal/ws/terminal", nil)
+		sess, err := startTerminal(r.WithContext(context.WithValue(r.Context(), principalKey{}, p)), termOptions{Record: tt.record})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sess.rec != nil; got != tt.want {
+			t.Errorf("all=%v role=%s record=%v: recording %v, want %v", tt.all, tt.role, tt.record, got, tt.want)
+		}
+		sess.Kill()
+	}
+}
+
+func TestTerminalWSLegacyGetsNoControlFrames(t *testing.T) {
+	srv := terminalTestServer(t)
+
+	// 旧协议客户端：只收到终端输出，会话结束时直接关闭
+	conn := dialTerminal(t, srv, "user=bob", []string{}...)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("echo legacy-$((6*7)); exit\n")); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Fatalf("read error = %v", err)
+			}
+			break
+		}
+		if typ != websocket.BinaryMessage {
+			t.Errorf("legacy client got a text frame: %s", msg)
+		}
+		out.Write(msg)
+	}
+	if !strings.Contains(out.String(), "legacy-42") {
+		t.Errorf("output %q does not contain the command's output", out.String())
+	}
+}
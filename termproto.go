@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// ============== Terminal WebSocket Protocol ==============
+//
+// Clients that negotiate the WebSocket subprotocol "portal.terminal.v2" use
+// framed messages: binary frames carry terminal data in both directions,
+// text frames carry JSON control messages. Clients without the subprotocol
+// get the legacy framing, where every frame is input unless it parses as
+// {"type":"resize",...}, and receive nothing but terminal output.
+//
+// Control messages from the client:
+//
+//	{"type":"resize","rows":24,"cols":80}
+//	{"type":"signal","signal":"INT"}       foreground process group; rw only
+//	{"type":"heartbeat","id":...}          answered with the same message
+//	{"type":"credit","bytes":65536}        output the client has consumed
+//
+// Control messages from the server: session, exit, idle_warning, idle,
+// transfer (see transfer.go), heartbeat and error.
+//
+// A connection for a session that does not exist (any more) or is not shared
+// with the user is closed with code termCloseNotFound.
+//
+// Flow control: a read-write v2 client starts with termCreditWindow bytes of
+// credit, which output uses up and credit messages replenish. While a client
+// is out of credit the PTY is not read, so a flood of output blocks the
+// program writing it instead of the browser.
+
+const (
+	termProtocolV2    = "portal.terminal.v2"
+	termCloseNotFound = 4404
+	termCreditWindow  = 256 << 10
+	// a client that stays out of credit this long is disconnected so it
+	// cannot stall the session for everyone else
+	termCreditStall = 10 * time.Second
+)
+
+// termControl is a control message from a v2 client.
+type termControl struct {
+	Type   string      `json:"type"`
+	Rows   int         `json:"rows"`
+	Cols   int         `json:"cols"`
+	Signal string      `json:"signal"`
+	Bytes  int         `json:"bytes"`
+	ID     interface{} `json:"id,omitempty"`
+}
+
+// Control handles a control message from a v2 client.
+func (s *TermSession) Control(c *termClient, msg []byte) {
+	var m termControl
+	if err := json.Unmarshal(msg, &m); err != nil {
+		c.control(map[string]interface{}{"type": "error", "message": "invalid control message"})
+		return
+	}
+	switch m.Type {
+	case "resize":
+		s.ClientResize(c, m.Rows, m.Cols)
+	case "signal":
+		sig, ok := parseSignal(m.Signal)
+		switch {
+		case c.mode != termModeRW:
+			c.control(map[string]interface{}{"type": "error", "message": "read-only clients cannot send signals"})
+		case !ok:
+			c.control(map[string]interface{}{"type": "error", "message": "unknown signal " + m.Signal})
+		default:
+			s.Signal(sig)
+		}
+	case "heartbeat":
+		c.control(map[string]interface{}{"type": "heartbeat", "id": m.ID})
+	case "credit":
+		c.addCredit(m.Bytes)
+	default:
+		c.control(map[string]interface{}{"type": "error", "message": "unknown message type " + m.Type})
+	}
+}
+
+// addCredit records that the client has consumed n bytes of output.
+func (c *termClient) addCredit(n int) {
+	if !c.flow || n <= 0 {
+		return
+	}
+	c.creditMu.Lock()
+	c.credit += n
+	c.creditMu.Unlock()
+	select {
+	case c.creditC <- struct{}{}:
+	default:
+	}
+}
+
+// spend charges n bytes of output against the client's credit.
+func (c *termClient) spend(n int) {
+	if !c.flow {
+		return
+	}
+	c.creditMu.Lock()
+	c.credit -= n
+	c.creditMu.Unlock()
+}
+
+// waitCredit blocks until the client has credit, has gone away, or deadline
+// has passed. It reports false on timeout.
+func (c *termClient) waitCredit(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		c.creditMu.Lock()
+		ok := c.credit > 0
+		c.creditMu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-c.creditC:
+		case <-c.closed:
+			return true
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// waitForCredit holds back PTY output until every flow-controlled client has
+// room for more. All clients share one termCreditStall deadline, so several
+// stalled clients hold the session up no longer than one.
+func (s *TermSession) waitForCredit() {
+	s.mu.Lock()
+	var flow []*termClient
+	for c := range s.clients {
+		if c.flow {
+			flow = append(flow, c)
+		}
+	}
+	s.mu.Unlock()
+	deadline := time.Now().Add(termCreditStall)
+	for _, c := range flow {
+		if !c.waitCredit(deadline) {
+			log.Printf("Terminal client %s@%s of session %s stopped consuming output, disconnecting", c.user, c.ip, s.ID)
+			c.close()
+		}
+	}
+}
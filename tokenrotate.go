@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ============== Shared Token Rotation ==============
+
+// sharedToken holds PORTAL_TOKEN and, during a grace period after rotation,
+// the token it replaced.
+var sharedToken struct {
+	sync.RWMutex
+	previous      string
+	previousUntil time.Time
+	rotatedAt     time.Time
+}
+
+// sharedTokenMatches reports whether s is the shared token, or the previous
+// one while its grace period lasts.
+func sharedTokenMatches(s string) bool {
+	if s == "" {
+		return false
+	}
+	sharedToken.RLock()
+	defer sharedToken.RUnlock()
+	if secureEqual(s, authToken) {
+		return true
+	}
+	return sharedToken.previous != "" && time.Now().Before(sharedToken.previousUntil) &&
+		secureEqual(s, sharedToken.previous)
+}
+
+// rotateSharedToken replaces the shared token, keeps the old one valid for
+// grace, writes the new one to .env, logs out every token-based session
+// except keepSessionID and revokes the API tokens created under the shared
+// token. It returns the new token and the number of revoked API tokens.
+func rotateSharedToken(grace time.Duration, keepSessionID string) (string, int, error) {
+	// .env 和内存中的 token 必须在同一把锁内更新，否则并发轮换后两者可能不一致
+	sharedToken.Lock()
+	newToken := generateToken()
+	if err := writeEnvValue(envFilePath(), "PORTAL_TOKEN", newToken); err != nil {
+		sharedToken.Unlock()
+		return "", 0, err
+	}
+	if grace > 0 {
+		sharedToken.previous = authToken
+		sharedToken.previousUntil = time.Now().Add(grace)
+	} else {
+		sharedToken.previous = ""
+	}
+	authToken = newToken
+	sharedToken.rotatedAt = time.Now()
+	sharedToken.Unlock()
+
+	sessions.RevokeUser(tokenUsername, keepSessionID)
+	return newToken, apiTokens.RevokeOwner(tokenUsername), nil
+}
+
+// maskToken keeps only enough of a token to tell two tokens apart.
+func maskToken(t string) string {
+	if len(t) <= 8 {
+		return strings.Repeat("*", len(t))
+	}
+	return t[:4] + strings.Repeat("*", len(t)-8) + t[len(t)-4:]
+}
+
+func envFilePath() string {
+	return filepath.Join(baseDir, ".env")
+}
+
+// writeEnvValue sets KEY=value in an env file, replacing an existing
+// assignment (keeping an "export " prefix) or appending one, and keeps the
+// file private.
+func writeEnvValue(path, key, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	found := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		export := strings.HasPrefix(trimmed, "export ")
+		if strings.HasPrefix(strings.TrimPrefix(trimmed, "export "), key+"=") {
+			lines[i] = key + "=" + value
+			if export {
+				lines[i] = "export " + lines[i]
+			}
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, key+"="+value)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readEnvValue returns the value of KEY in an env file.
+func readEnvValue(path, key string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "export ")
+		if strings.HasPrefix(line, key+"=") {
+			return strings.Trim(strings.TrimPrefix(line, key+"="), `"'`)
+		}
+	}
+	return ""
+}
+
+func handleMgmtTokenRotate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Grace string `json:"grace"` // e.g. "10m"; empty revokes the old token immediately
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	var grace time.Duration
+	if req.Grace != "" {
+		var err error
+		if grace, err = time.ParseDuration(req.Grace); err != nil || grace < 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Invalid grace period",
+			})
+			return
+		}
+	}
+
+	newToken, revoked, err := rotateSharedToken(grace, principalFrom(r).SessionID)
+	audit(r, "token.rotate", fmt.Sprintf("grace %s, %d api tokens revoked", grace, revoked), err)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Failed to save token: " + err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":            true,
+		"token":              newToken,
+		"grace":              grace.String(),
+		"revoked_api_tokens": revoked,
+	})
+}
+
+// ============== rotate-token Subcommand ==============
+
+// rotateTokenURL returns the rotate endpoint of a portal listening on addr and
+// port. An unspecified listen address is reached over loopback.
+func rotateTokenURL(addr, port string) string {
+	if ip := net.ParseIP(addr); addr == "" || (ip != nil && ip.IsUnspecified()) {
+		addr = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(addr, port) + "/portal/api/mgmt/token/rotate"
+}
+
+// runRotateTokenCommand implements "portal rotate-token". It asks the running
+// portal to rotate so that terminal sessions survive; only when nothing
+// listens on its address does it update .env by itself. Any other failure is
+// returned, as the running portal would keep accepting the old token.
+func runRotateTokenCommand(args []string) error {
+	fs := flag.NewFlagSet("rotate-token", flag.ExitOnError)
+	grace := fs.Duration("grace", 0, "keep the old token valid for this long")
+	fs.Parse(args)
+
+	envPath := envFilePath()
+	current := os.Getenv("PORTAL_TOKEN")
+	if current == "" {
+		current = readEnvValue(envPath, "PORTAL_TOKEN")
+	}
+	port := portalPort
+	if p := readEnvValue(envPath, "PORTAL_PORT"); p != "" && os.Getenv("PORTAL_PORT") == "" {
+		port = p
+	}
+	addr := os.Getenv("PORTAL_LISTEN_ADDR")
+	if addr == "" {
+		addr = readEnvValue(envPath, "PORTAL_LISTEN_ADDR")
+	}
+
+	body := strings.NewReader(fmt.Sprintf(`{"grace": %q}`, grace.String()))
+	req, _ := http.NewRequest("POST", rotateTokenURL(addr, port), body)
+	req.Header.Set("Authorization", "Bearer "+current)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("cannot reach the running portal (.env left unchanged): %w", err)
+	}
+	if err != nil {
+		// Portal 未运行，直接写入 .env
+		newToken := generateToken()
+		if err := writeEnvValue(envPath, "PORTAL_TOKEN", newToken); err != nil {
+			return err
+		}
+		fmt.Printf("Portal is not running; new token written to %s\n%s\n", envPath, newToken)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rotate request failed (.env left unchanged): %s", resp.Status)
+	}
+	var result struct {
+		Success bool   `json:"success"`
+		Token   string `json:"token"`
+		Revoked int    `json:"revoked_api_tokens"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return errors.New(result.Error)
+	}
+	if result.Revoked > 0 {
+		fmt.Fprintf(os.Stderr, "Revoked %d API token(s) created with the old shared token\n", result.Revoked)
+	}
+	fmt.Println(result.Token)
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotateTokenURL(t *testing.T) {
+	tests := []struct{ addr, want string }{
+		{"", "http://127.0.0.1:8000/portal/api/mgmt/token/rotate"},
+		{"0.0.0.0", "http://127.0.0.1:8000/portal/api/mgmt/token/rotate"},
+		{"::", "http://127.0.0.1:8000/portal/api/mgmt/token/rotate"},
+		{"10.0.0.5", "http://10.0.0.5:8000/portal/api/mgmt/token/rotate"},
+		{"::1", "http://[::1]:8000/portal/api/mgmt/token/rotate"},
+	}
+	for _, tt := range tests {
+		if got := rotateTokenURL(tt.addr, "8000"); got != tt.want {
+			t.Errorf("rotateTokenURL(%q) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// setupRotateToken writes a .env pointing rotate-token at addr.
+func setupRotateToken(t *testing.T, addr string) string {
+	t.Helper()
+	oldBase := baseDir
+	t.Cleanup(func() { baseDir = oldBase })
+	baseDir = t.TempDir()
+	t.Setenv("PORTAL_TOKEN", "")
+	t.Setenv("PORTAL_PORT", "")
+	t.Setenv("PORTAL_LISTEN_ADDR", "")
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := "PORTAL_TOKEN=old\nPORTAL_PORT=" + port + "\nPORTAL_LISTEN_ADDR=" + host + "\n"
+	if err := os.WriteFile(envFilePath(), []byte(env), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return envFilePath()
+}
+
+func TestRotateTokenCommandKeepsEnvOnError(t *testing.T) {
+	// 例如被 IP 过滤拒绝：不能只改 .env 而让运行中的 Portal 继续接受旧 token
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	envPath := setupRotateToken(t, srv.Listener.Addr().String())
+
+	if err := runRotateTokenCommand(nil); err == nil {
+		t.Fatal("rotate-token succeeded against a portal that refused the request")
+	}
+	if got := readEnvValue(envPath, "PORTAL_TOKEN"); got != "old" {
+		t.Errorf("PORTAL_TOKEN = %q, want it unchanged", got)
+	}
+}
+
+func TestRotateTokenCommandKeepsEnvOnBrokenConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	envPath := setupRotateToken(t, l.Addr().String())
+
+	if err := runRotateTokenCommand(nil); err == nil {
+		t.Fatal("rotate-token succeeded although the request failed")
+	}
+	if got := readEnvValue(envPath, "PORTAL_TOKEN"); got != "old" {
+		t.Errorf("PORTAL_TOKEN = %q, want it unchanged", got)
+	}
+}
+
+func TestRotateTokenCommandPortalNotRunning(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() // 连接被拒绝
+	envPath := setupRotateToken(t, addr)
+
+	if err := runRotateTokenCommand(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readEnvValue(envPath, "PORTAL_TOKEN"); got == "old" || !validToken(got) {
+		t.Errorf("PORTAL_TOKEN = %q, want a new token", got)
+	}
+}
+
+func TestRotateTokenCommandUsesListenAddr(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"success": true, "token": "new"}`))
+	}))
+	defer srv.Close()
+	envPath := setupRotateToken(t, srv.Listener.Addr().String())
+
+	if err := runRotateTokenCommand(nil); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer old" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	// 运行中的 Portal 自己写 .env
+	if got := readEnvValue(envPath, "PORTAL_TOKEN"); got != "old" {
+		t.Errorf("PORTAL_TOKEN = %q, want it left to the portal", got)
+	}
+}
+
+func TestWriteEnvValueKeepsExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	os.WriteFile(path, []byte("# portal\nexport PORTAL_TOKEN=old\nPORTAL_PORT=8000\n"), 0600)
+	if err := writeEnvValue(path, "PORTAL_TOKEN", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEnvValue(path, "PORTAL_PORT", "9000"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if want := "# portal\nexport PORTAL_TOKEN=new\nPORTAL_PORT=9000\n"; string(data) != want {
+		t.Errorf(".env = %q, want %q", data, want)
+	}
+}
+
+func TestRotateSharedToken(t *testing.T) {
+	dir := t.TempDir()
+	oldBase, oldToken, oldSessions, oldAPITokens := baseDir, authToken, sessions, apiTokens
+	t.Cleanup(func() { baseDir, authToken, sessions, apiTokens = oldBase, oldToken, oldSessions, oldAPITokens })
+	baseDir, authToken = dir, "old"
+	var err error
+	if sessions, err = loadSessionStore(filepath.Join(dir, "sessions.json"), time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if apiTokens, err = loadAPITokenStore(filepath.Join(dir, "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range []string{tokenUsername, tokenUsername, "alice"} {
+		if _, _, err := apiTokens.Create(owner, "ci", []string{ScopeFilesRead}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 并发轮换后 .env 中的 token 必须与正在使用的一致
+	var wg sync.WaitGroup
+	revoked := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, n, err := rotateSharedToken(0, "")
+			if err != nil {
+				t.Error(err)
+			}
+			revoked <- n
+		}()
+	}
+	wg.Wait()
+	close(revoked)
+
+	sharedToken.RLock()
+	current := authToken
+	sharedToken.RUnlock()
+	if got := readEnvValue(envFilePath(), "PORTAL_TOKEN"); got != current {
+		t.Errorf(".env has %q, portal uses %q", got, current)
+	}
+	total := 0
+	for n := range revoked {
+		total += n
+	}
+	if total != 2 || len(apiTokens.List(tokenUsername)) != 0 || len(apiTokens.List("alice")) != 1 {
+		t.Errorf("revoked %d API tokens; shared token has %d left, alice %d", total, len(apiTokens.List(tokenUsername)), len(apiTokens.List("alice")))
+	}
+}
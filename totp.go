@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== TOTP (RFC 6238) ==============
+
+const (
+	totpDigits   = 6
+	totpPeriod   = 30
+	totpIssuer   = "Portal"
+	totpSkew     = 1 // accepted clock drift in periods, either side
+	recoveryKeys = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// hotp computes an RFC 4226 one-time password for counter.
+func hotp(h func() hash.Hash, key []byte, counter uint64, digits int) string {
+	mac := hmac.New(h, key)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// totpCounter returns the RFC 6238 time step for t.
+func totpCounter(t time.Time, period int64) uint64 {
+	return uint64(t.Unix() / period)
+}
+
+func generateTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// totpURI builds the otpauth:// provisioning URI that authenticator apps scan as a QR code.
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// ============== TOTP Store ==============
+
+type totpEntry struct {
+	Secret        string   `json:"secret,omitempty"`
+	PendingSecret string   `json:"pending_secret,omitempty"`
+	Enabled       bool     `json:"enabled"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // SHA-256 hashes
+	LastCounter   uint64   `json:"last_counter,omitempty"`
+}
+
+type TOTPStore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*totpEntry
+}
+
+var totp *TOTPStore
+
+func loadTOTPStore(path string) (*TOTPStore, error) {
+	s := &TOTPStore{path: path, entries: make(map[string]*totpEntry)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *TOTPStore) Enabled(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[username]
+	return ok && e.Enabled
+}
+
+// Status reports whether TOTP is on for username and how many recovery codes remain.
+func (s *TOTPStore) Status(username string) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[username]
+	if !ok {
+		return false, 0
+	}
+	return e.Enabled, len(e.RecoveryCodes)
+}
+
+// Begin stores a new pending secret for username. It only becomes active once confirmed.
+func (s *TOTPStore) Begin(username string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[username]
+	if e == nil {
+		e = &totpEntry{}
+		s.entries[username] = e
+	}
+	e.PendingSecret = generateTOTPSecret()
+	return e.PendingSecret, writeJSONFile(s.path, s.entries)
+}
+
+// Confirm activates the pending secret if code matches it and returns fresh recovery codes.
+func (s *TOTPStore) Confirm(username, code string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[username]
+	if e == nil || e.PendingSecret == "" {
+		return nil, errors.New("no enrollment in progress")
+	}
+	counter, ok := matchTOTP(e.PendingSecret, code, 0, time.Now())
+	if !ok {
+		return nil, errors.New("invalid code")
+	}
+	e.Secret = e.PendingSecret
+	e.PendingSecret = ""
+	e.Enabled = true
+	e.LastCounter = counter
+	codes := e.newRecoveryCodes()
+	return codes, writeJSONFile(s.path, s.entries)
+}
+
+// Verify checks a TOTP code or, failing that, consumes a recovery code.
+// A TOTP code can only be used once.
+func (s *TOTPStore) Verify(username, code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[username]
+	if e == nil || !e.Enabled {
+		return false
+	}
+	if counter, ok := matchTOTP(e.Secret, code, e.LastCounter, time.Now()); ok {
+		e.LastCounter = counter
+		writeJSONFile(s.path, s.entries)
+		return true
+	}
+	want := hashRecoveryCode(code)
+	for i, h := range e.RecoveryCodes {
+		if hmac.Equal([]byte(h), []byte(want)) {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			writeJSONFile(s.path, s.entries)
+			return true
+		}
+	}
+	return false
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of username.
+func (s *TOTPStore) RegenerateRecoveryCodes(username string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[username]
+	if e == nil || !e.Enabled {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+	codes := e.newRecoveryCodes()
+	return codes, writeJSONFile(s.path, s.entries)
+}
+
+func (s *TOTPStore) Disable(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, username)
+	return writeJSONFile(s.path, s.entries)
+}
+
+func (e *totpEntry) newRecoveryCodes() []string {
+	codes := make([]string, recoveryKeys)
+	e.RecoveryCodes = make([]string, recoveryKeys)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		c := hex.EncodeToString(b)
+		codes[i] = c[:5] + "-" + c[5:]
+		e.RecoveryCodes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchTOTP checks code against the steps around now, ignoring steps at or
+// before lastCounter so that a code cannot be replayed.
+func matchTOTP(secret, code string, lastCounter uint64, now time.Time) (uint64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	current := totpCounter(now, totpPeriod)
+	for d := -totpSkew; d <= totpSkew; d++ {
+		counter := current + uint64(d)
+		if counter <= lastCounter {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(sha1.New, key, counter, totpDigits)), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// ============== Login Second Step ==============
+
+// mfaChallenge is a login that passed the password/token check and still
+// needs a TOTP or recovery code.
+type mfaChallenge struct {
+	username string
+	expires  time.Time
+	attempts int
+}
+
+const (
+	mfaChallengeTTL = 5 * time.Minute
+	mfaMaxAttempts  = 5
+)
+
+var mfaChallenges = struct {
+	sync.Mutex
+	m map[string]*mfaChallenge
+}{m: make(map[string]*mfaChallenge)}
+
+func startMFAChallenge(w http.ResponseWriter, username string) {
+	id := generateToken()
+	mfaChallenges.Lock()
+	now := time.Now()
+	for k, c := range mfaChallenges.m {
+		if now.After(c.expires) {
+			delete(mfaChallenges.m, k)
+		}
+	}
+	mfaChallenges.m[id] = &mfaChallenge{username: username, expires: now.Add(mfaChallengeTTL)}
+	mfaChallenges.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     "portal_mfa",
+		Value:    id,
+		Path:     "/login",
+		HttpOnly: true,
+		MaxAge:   int(mfaChallengeTTL / time.Second),
+	})
+}
+
+// finishMFAChallenge checks code for the challenge in the portal_mfa cookie and
+// returns the username on success.
+func finishMFAChallenge(w http.ResponseWriter, r *http.Request, code string) (string, bool) {
+	cookie, err := r.Cookie("portal_mfa")
+	if err != nil {
+		return "", false
+	}
+	mfaChallenges.Lock()
+	c, ok := mfaChallenges.m[cookie.Value]
+	if !ok || time.Now().After(c.expires) {
+		delete(mfaChallenges.m, cookie.Value)
+		mfaChallenges.Unlock()
+		return "", false
+	}
+	c.attempts++
+	if c.attempts > mfaMaxAttempts {
+		delete(mfaChallenges.m, cookie.Value)
+		mfaChallenges.Unlock()
+		return "", false
+	}
+	username := c.username
+	mfaChallenges.Unlock()
+
+	if !totp.Verify(username, code) {
+		return "", false
+	}
+	mfaChallenges.Lock()
+	delete(mfaChallenges.m, cookie.Value)
+	mfaChallenges.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: "portal_mfa", Value: "", Path: "/login", MaxAge: -1})
+	return username, true
+}
+
+// ============== TOTP Enrollment API ==============
+
+func handleTOTPAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p := principalFrom(r)
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/totp"), "/")
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if r.Method == "POST" || r.Method == "DELETE" {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+
+	switch {
+	case r.Method == "GET" && action == "":
+		enabled, left := totp.Status(p.Username)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enabled":             enabled,
+			"recovery_codes_left": left,
+		})
+
+	case r.Method == "POST" && action == "enroll":
+		if isExternalUser(p.Username) {
+			http.Error(w, "Two-factor authentication is managed by your identity provider", http.StatusBadRequest)
+			return
+		}
+		if totp.Enabled(p.Username) {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		secret, err := totp.Begin(p.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret": secret,
+			"uri":    totpURI(p.Username, secret),
+		})
+
+	case r.Method == "POST" && action == "confirm":
+		codes, err := totp.Confirm(p.Username, req.Code)
+		audit(r, "totp.enable", p.Username, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+
+	case r.Method == "POST" && action == "recovery-codes":
+		if !totp.Verify(p.Username, req.Code) {
+			http.Error(w, "Invalid code", http.StatusForbidden)
+			return
+		}
+		codes, err := totp.RegenerateRecoveryCodes(p.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+
+	case r.Method == "DELETE" && action == "":
+		// 管理员可以为丢失设备的用户重置两步验证
+		target := r.URL.Query().Get("user")
+		if target != "" && target != p.Username {
+			if p.Role != RoleAdmin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		} else {
+			target = p.Username
+			if totp.Enabled(target) && !totp.Verify(target, req.Code) {
+				http.Error(w, "Invalid code", http.StatusForbidden)
+				return
+			}
+		}
+		err := totp.Disable(target)
+		audit(r, "totp.disable", target, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B, SHA-1 with the 20-byte ASCII key "12345678901234567890".
+func TestHOTPRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		counter := totpCounter(time.Unix(tt.unix, 0), 30)
+		if got := hotp(sha1.New, key, counter, 8); got != tt.want {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func totpCode(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(sha1.New, key, totpCounter(now, totpPeriod), totpDigits)
+}
+
+func TestMatchTOTPWindow(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	step := totpPeriod * time.Second
+
+	for _, d := range []time.Duration{-step, 0, step} {
+		code := totpCode(t, secret, now.Add(d))
+		counter, ok := matchTOTP(secret, code, 0, now)
+		if !ok {
+			t.Errorf("code from %v away rejected", d)
+			continue
+		}
+		if want := totpCounter(now.Add(d), totpPeriod); counter != want {
+			t.Errorf("counter = %d, want %d", counter, want)
+		}
+	}
+	for _, d := range []time.Duration{-2 * step, 2 * step} {
+		if _, ok := matchTOTP(secret, totpCode(t, secret, now.Add(d)), 0, now); ok {
+			t.Errorf("code from %v away accepted", d)
+		}
+	}
+	if _, ok := matchTOTP(secret, "12345", 0, now); ok {
+		t.Error("short code accepted")
+	}
+}
+
+func TestMatchTOTPReplay(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	code := totpCode(t, secret, now)
+
+	counter, ok := matchTOTP(secret, code, 0, now)
+	if !ok {
+		t.Fatal("valid code rejected")
+	}
+	if _, ok := matchTOTP(secret, code, counter, now); ok {
+		t.Error("replayed code accepted")
+	}
+	// 已用过较新的时间步后，上一步的代码也不能再用
+	prev := totpCode(t, secret, now.Add(-totpPeriod*time.Second))
+	if _, ok := matchTOTP(secret, prev, counter, now); ok {
+		t.Error("code older than the last used step accepted")
+	}
+	next := totpCode(t, secret, now.Add(totpPeriod*time.Second))
+	if _, ok := matchTOTP(secret, next, counter, now); !ok {
+		t.Error("code of the next step rejected")
+	}
+}
+
+func TestTOTPStoreVerify(t *testing.T) {
+	s, err := loadTOTPStore(filepath.Join(t.TempDir(), "portal-totp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.Begin("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Confirm("alice", "000000x"); err == nil {
+		t.Fatal("Confirm accepted an invalid code")
+	}
+	// 用上一步的代码确认，当前代码仍可用于登录
+	codes, err := s.Confirm("alice", totpCode(t, secret, time.Now().Add(-totpPeriod*time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryKeys {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryKeys)
+	}
+
+	code := totpCode(t, secret, time.Now())
+	if !s.Verify("alice", code) {
+		t.Fatal("valid code rejected")
+	}
+	if s.Verify("alice", code) {
+		t.Error("replayed code accepted")
+	}
+
+	if !s.Verify("alice", codes[0]) {
+		t.Fatal("recovery code rejected")
+	}
+	if s.Verify("alice", codes[0]) {
+		t.Error("recovery code accepted twice")
+	}
+	if _, n := s.Status("alice"); n != recoveryKeys-1 {
+		t.Errorf("%d recovery codes left, want %d", n, recoveryKeys-1)
+	}
+
+	// 重新加载后状态不变
+	s2, err := loadTOTPStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.Verify("alice", codes[0]) || s2.Verify("alice", code) {
+		t.Error("used codes accepted after reload")
+	}
+	if !s2.Verify("alice", codes[1]) {
+		t.Error("unused recovery code rejected after reload")
+	}
+}
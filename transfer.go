@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============== Terminal File Transfer ==============
+//
+// portal-send and portal-recv, installed on the PATH of every terminal, ask
+// the portal for a transfer by writing a private OSC sequence to the
+// terminal:
+//
+//	ESC ] 5113 ; <token> ; send ; <base64 cwd> ; <base64 file> BEL
+//	ESC ] 5113 ; <token> ; recv ; <base64 cwd> ; <base64 dir> BEL
+//
+// The token is a per-session secret in $PORTAL_TRANSFER_TOKEN, so output
+// that merely contains the sequence (e.g. cat of a crafted file) cannot
+// start a transfer. The sequences are removed from the output before it
+// reaches clients, the scrollback or a recording. The session owner's page
+// then gets a {"type":"transfer"} control message and downloads or uploads
+// through the sessions API.
+
+const (
+	transferOSC     = "\x1b]5113;"
+	transferMaxOSC  = 16 << 10 // longer sequences are not ours
+	transferTimeout = 10 * time.Minute
+)
+
+// termTransfer is a pending download (send) or upload (recv).
+type termTransfer struct {
+	ID      string
+	Send    bool   // download Path to the browser; otherwise upload into Path
+	Path    string // absolute
+	Expires time.Time
+}
+
+// transferHelperDir holds portal-send and portal-recv; empty if they could
+// not be installed.
+var transferHelperDir string
+
+const portalSendScript = `#!/bin/sh
+# portal-send FILE... - download files from this terminal to the browser
+if [ -z "$PORTAL_TRANSFER_TOKEN" ]; then
+	echo "portal-send: not running in a portal terminal" >&2
+	exit 1
+fi
+if [ $# -eq 0 ]; then
+	echo "usage: portal-send FILE..." >&2
+	exit 2
+fi
+b64() { printf '%s' "$1" | base64 | tr -d '\n'; }
+status=0
+for f in "$@"; do
+	if [ ! -f "$f" ] || [ ! -r "$f" ]; then
+		echo "portal-send: $f: not a readable file" >&2
+		status=1
+		continue
+	fi
+	printf '\033]5113;%s;send;%s;%s\007' "$PORTAL_TRANSFER_TOKEN" "$(b64 "$PWD")" "$(b64 "$f")" >/dev/tty
+done
+exit $status
+`
+
+const portalRecvScript = `#!/bin/sh
+# portal-recv [DIR] - upload files from the browser into DIR (default: .)
+if [ -z "$PORTAL_TRANSFER_TOKEN" ]; then
+	echo "portal-recv: not running in a portal terminal" >&2
+	exit 1
+fi
+dir=${1:-.}
+if [ ! -d "$dir" ] || [ ! -w "$dir" ]; then
+	echo "portal-recv: $dir: not a writable directory" >&2
+	exit 1
+fi
+b64() { printf '%s' "$1" | base64 | tr -d '\n'; }
+printf '\033]5113;%s;recv;%s;%s\007' "$PORTAL_TRANSFER_TOKEN" "$(b64 "$PWD")" "$(b64 "$dir")" >/dev/tty
+echo "portal-recv: choose the files in the browser" >&2
+`
+
+// installTransferHelpers writes portal-send and portal-recv into dir.
+func installTransferHelpers(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, script := range map[string]string{"portal-send": portalSendScript, "portal-recv": portalRecvScript} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			return err
+		}
+	}
+	transferHelperDir = dir
+	return nil
+}
+
+// transferEnv adds the session id, the transfer token and the helpers'
+// directory to a shell's environment.
+func transferEnv(env []string, id, token string) []string {
+	env = append(env, "PORTAL_SESSION_ID="+id, "PORTAL_TRANSFER_TOKEN="+token)
+	if transferHelperDir == "" {
+		return env
+	}
+	path := os.Getenv("PATH")
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			path = v
+		}
+	}
+	return append(env, "PATH="+transferHelperDir+string(os.PathListSeparator)+path)
+}
+
+// filterTransfers removes transfer requests from PTY output and acts on them.
+// A sequence cut between two reads is held back until the rest arrives. It
+// is only called from pump.
+func (s *TermSession) filterTransfers(data []byte) []byte {
+	if len(s.oscCarry) > 0 {
+		data = append(s.oscCarry, data...)
+		s.oscCarry = nil
+	}
+	if !bytes.Contains(data, []byte{0x1b}) {
+		return data
+	}
+	var out []byte
+	for {
+		i := bytes.Index(data, []byte(transferOSC))
+		if i < 0 {
+			// 末尾可能是被截断的序列开头
+			keep := 0
+			for n := min(len(transferOSC)-1, len(data)); n > 0; n-- {
+				if bytes.HasSuffix(data, []byte(transferOSC[:n])) {
+					keep = n
+					break
+				}
+			}
+			s.oscCarry = append([]byte(nil), data[len(data)-keep:]...)
+			return append(out, data[:len(data)-keep]...)
+		}
+		out = append(out, data[:i]...)
+		rest := data[i+len(transferOSC):]
+		end := bytes.IndexByte(rest, 0x07)
+		if end < 0 {
+			if len(rest) < transferMaxOSC {
+				s.oscCarry = append([]byte(nil), data[i:]...)
+				return out
+			}
+			// 太长，不是我们的序列，原样输出
+			out = append(out, data[i:i+len(transferOSC)]...)
+			data = rest
+			continue
+		}
+		s.handleTransferOSC(string(rest[:end]))
+		data = rest[end+1:]
+	}
+}
+
+// handleTransferOSC parses "<token>;<verb>;<b64 cwd>;<b64 path>".
+func (s *TermSession) handleTransferOSC(payload string) {
+	parts := strings.Split(payload, ";")
+	if len(parts) != 4 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(s.transferToken)) != 1 {
+		return
+	}
+	cwd, err1 := base64.StdEncoding.DecodeString(parts[2])
+	path, err2 := base64.StdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || len(path) == 0 {
+		return
+	}
+	// 相对路径按 helper 所在目录解析，缺省时用 shell 的当前目录
+	dir := string(cwd)
+	if dir == "" {
+		dir, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", s.cmd.Process.Pid))
+	}
+	abs := string(path)
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(dir, abs)
+	}
+
+	t := &termTransfer{ID: generateToken(), Path: filepath.Clean(abs), Expires: time.Now().Add(transferTimeout)}
+	msg := map[string]interface{}{"type": "transfer", "id": t.ID}
+	switch parts[1] {
+	case "send":
+		info, err := os.Stat(t.Path)
+		if err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		t.Send = true
+		msg["direction"] = "download"
+		msg["name"] = filepath.Base(t.Path)
+		msg["size"] = info.Size()
+	case "recv":
+		if info, err := os.Stat(t.Path); err != nil || !info.IsDir() {
+			return
+		}
+		msg["direction"] = "upload"
+		msg["dir"] = t.Path
+	default:
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, old := range s.transfers {
+		if now.After(old.Expires) {
+			delete(s.transfers, id)
+		}
+	}
+	s.transfers[t.ID] = t
+	// 只有会话所有者能通过 API 完成传输
+	for c := range s.clients {
+		if c.user == s.Owner && c.mode == termModeRW {
+			c.control(msg)
+		}
+	}
+}
+
+// transfer returns the pending transfer id if method applies to it. Downloads
+// and DELETE remove it, so a file can only be fetched once; an upload stays
+// open for several files until the page deletes it.
+func (s *TermSession) transfer(id, method string) *termTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transfers[id]
+	if !ok || time.Now().After(t.Expires) {
+		return nil
+	}
+	switch {
+	case method == "DELETE", method == "GET" && t.Send:
+		delete(s.transfers, id)
+	case method == "POST" && !t.Send:
+	default:
+		return nil
+	}
+	return t
+}
+
+// handleTransfer serves
+//
+//	GET    /portal/api/terminal/sessions/<id>/transfers/<tid>             download (portal-send)
+//	POST   /portal/api/terminal/sessions/<id>/transfers/<tid>?name=<file>  upload one file (portal-recv)
+//	DELETE /portal/api/terminal/sessions/<id>/transfers/<tid>             cancel or finish
+func handleTransfer(w http.ResponseWriter, r *http.Request, sess *TermSession, tid string) {
+	if principalFrom(r).Username != sess.Owner {
+		http.Error(w, "Transfers belong to the session owner", http.StatusForbidden)
+		return
+	}
+	t := sess.transfer(tid, r.Method)
+	if t == nil {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		f, err := os.Open(t.Path)
+		audit(r, "terminal.download", t.Path, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		info, _ := f.Stat()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(t.Path)}))
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		io.Copy(w, f)
+
+	case "POST":
+		name := filepath.Base(r.URL.Query().Get("name"))
+		if name == "" || name == "." || name == "/" || name == ".." {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		dst := filepath.Join(t.Path, name)
+		// 不覆盖已有文件
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			audit(r, "terminal.upload", dst, err)
+			status := http.StatusInternalServerError
+			if os.IsExist(err) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		n, err := io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+		audit(r, "terminal.upload", dst, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Terminal session %s received %s (%d bytes)", sess.ID, dst, n)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"success":true,"path":%q,"size":%d}`+"\n", dst, n)
+
+	case "DELETE":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"success":true}` + "\n"))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
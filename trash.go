@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ============== Trash ==============
+
+// Deleting through the file API moves the item into the trash directory of
+// its root, <root>/.portal-trash, as <id> next to <id>.json holding the
+// metadata. Staying on the same filesystem makes both the delete and the
+// restore a rename. The trash directory is hidden from the file API.
+
+const trashDirName = ".portal-trash"
+
+var (
+	errTrashPath     = errors.New("the trash is only reachable through the trash API")
+	errTrashConflict = errors.New("a file already exists at the original path")
+)
+
+// TrashEntry describes a deleted file or directory.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Root      string    `json:"root"`
+	Path      string    `json:"path"` // relative to the root
+	IsDir     bool      `json:"isDir"`
+	Size      int64     `json:"size"`
+	DeletedBy string    `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// TrashStore moves deleted items into the trash and prunes it by age and
+// size.
+type TrashStore struct {
+	mu       sync.Mutex
+	maxAge   time.Duration // 0: keep forever
+	maxBytes int64         // per root; 0: no size limit
+}
+
+var trash = &TrashStore{}
+
+func newTrashStore(maxAge time.Duration, maxBytes int64) *TrashStore {
+	t := &TrashStore{maxAge: maxAge, maxBytes: maxBytes}
+	t.Prune()
+	go func() {
+		for range time.Tick(time.Hour) {
+			t.Prune()
+		}
+	}()
+	return t
+}
+
+// dir returns the trash directory of the root that p belongs to.
+func (t *TrashStore) dir(root *FileRoot) (string, error) {
+	top, err := filepath.EvalSymlinks(root.dir())
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(top, trashDirName), nil
+}
+
+// Move puts p into the trash of its root.
+func (t *TrashStore) Move(p *rootPath, user string) (*TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.move(p, user)
+}
+
+func (t *TrashStore) move(p *rootPath, user string) (*TrashEntry, error) {
+	if p.Rel == "" {
+		return nil, errors.New("cannot delete a file root")
+	}
+	info, err := os.Lstat(p.Abs)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := t.dir(p.Root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	e := &TrashEntry{
+		ID:        generateToken(),
+		Root:      p.Root.Name,
+		Path:      p.Rel,
+		IsDir:     info.IsDir(),
+		Size:      diskUsage(p.Abs),
+		DeletedBy: user,
+		DeletedAt: time.Now().UTC(),
+	}
+	data, _ := json.MarshalIndent(e, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, e.ID+".json"), data, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(p.Abs, filepath.Join(dir, e.ID)); err != nil {
+		os.Remove(filepath.Join(dir, e.ID+".json"))
+		if errors.Is(err, syscall.EXDEV) {
+			// 挂载点下的文件无法移动到回收站
+			return nil, fmt.Errorf("%s is on another filesystem than the trash; delete it permanently instead", p.Spec())
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// diskUsage returns the total size of the files under p.
+func diskUsage(p string) int64 {
+	var total int64
+	filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// List returns the trash entries of root, newest first.
+func (t *TrashStore) List(root *FileRoot) []*TrashEntry {
+	list := []*TrashEntry{}
+	dir, err := t.dir(root)
+	if err != nil {
+		return list
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, de := range entries {
+		id, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if e, err := t.get(root, id); err == nil {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+	return list
+}
+
+func (t *TrashStore) get(root *FileRoot, id string) (*TrashEntry, error) {
+	if !validToken(id) {
+		return nil, os.ErrNotExist
+	}
+	dir, err := t.dir(root)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	e := &TrashEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	e.ID, e.Root = id, root.Name
+	return e, nil
+}
+
+// Restore moves entry id back to its original path. conflict says what to do
+// when that path is taken again: "fail" (default), "rename" to restore next
+// to it, or "overwrite", which moves the existing item to the trash first.
+// It returns the restored path.
+func (t *TrashStore) Restore(root *FileRoot, id, conflict, user string) (*rootPath, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.get(root, id)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := resolveRootPath(root.Name + ":" + e.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(dst.Abs); err == nil {
+		switch conflict {
+		case "", "fail":
+			return nil, errTrashConflict
+		case "rename":
+			if dst, err = restoredName(dst); err != nil {
+				return nil, err
+			}
+		case "overwrite":
+			if _, err := t.move(dst, user); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown conflict mode %q", conflict)
+		}
+	}
+	// 原目录可能也已被删除
+	if err := os.MkdirAll(filepath.Dir(dst.Abs), 0755); err != nil {
+		return nil, err
+	}
+	dir, _ := t.dir(root)
+	if err := os.Rename(filepath.Join(dir, id), dst.Abs); err != nil {
+		return nil, err
+	}
+	os.Remove(filepath.Join(dir, id+".json"))
+	return dst, nil
+}
+
+// restoredName finds a free name like "report (restored 2).pdf" next to p.
+func restoredName(p *rootPath) (*rootPath, error) {
+	dir, base := path.Split(p.Rel)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; i < 1000; i++ {
+		suffix := " (restored)"
+		if i > 1 {
+			suffix = fmt.Sprintf(" (restored %d)", i)
+		}
+		np, err := resolveRootPath(p.Root.Name + ":" + dir + stem + suffix + ext)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(np.Abs); os.IsNotExist(err) {
+			return np, nil
+		}
+	}
+	return nil, errTrashConflict
+}
+
+// Purge permanently deletes entry id.
+func (t *TrashStore) Purge(root *FileRoot, id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.purge(root, id)
+}
+
+func (t *TrashStore) purge(root *FileRoot, id string) error {
+	if !validToken(id) {
+		return os.ErrNotExist
+	}
+	dir, err := t.dir(root)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(dir, id)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, id+".json"))
+}
+
+// Prune purges entries older than maxAge, then the oldest ones until each
+// root's trash fits in maxBytes.
+func (t *TrashStore) Prune() {
+	for _, root := range portalConfig.FileRoots {
+		list := t.List(root)
+		t.mu.Lock()
+		var total int64
+		for _, e := range list {
+			total += e.Size
+		}
+		for i := len(list) - 1; i >= 0; i-- {
+			e := list[i]
+			tooOld := t.maxAge > 0 && time.Since(e.DeletedAt) > t.maxAge
+			tooBig := t.maxBytes > 0 && total > t.maxBytes
+			if !tooOld && !tooBig {
+				continue
+			}
+			if err := t.purge(root, e.ID); err == nil {
+				total -= e.Size
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// handleTrashAPI manages the trash:
+//
+//	GET    /portal/api/trash?root=<root>     list (all roots without root)
+//	POST   /portal/api/trash/<root>/<id>     restore {conflict: "fail"|"rename"|"overwrite"}
+//	DELETE /portal/api/trash/<root>/<id>     purge one entry
+//	DELETE /portal/api/trash/<root>          empty the root's trash
+func handleTrashAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/trash"), "/")
+	name, id, _ := strings.Cut(rest, "/")
+
+	if name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list := []*TrashEntry{}
+		for _, root := range portalConfig.FileRoots {
+			if q := r.URL.Query().Get("root"); (q == "" || q == root.Name) && root.Write {
+				list = append(list, trash.List(root)...)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+		json.NewEncoder(w).Encode(map[string]interface{}{"entries": list})
+		return
+	}
+
+	// 恢复和清除都需要根目录可写
+	p, ok := resolveFilePath(w, name+":", true)
+	if !ok {
+		return
+	}
+	root := p.Root
+
+	switch {
+	case r.Method == "POST" && id != "":
+		var req struct {
+			Conflict string `json:"conflict"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		dst, err := trash.Restore(root, id, req.Conflict, principalFrom(r).Username)
+		target := root.Name + ":" + id
+		if dst != nil {
+			target = dst.Abs
+		}
+		audit(r, "files.restore", target, err)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "Trash entry not found", http.StatusNotFound)
+		case errors.Is(err, errTrashConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"status": "ok", "path": dst.Spec()})
+		}
+
+	case r.Method == "DELETE" && id != "":
+		err := trash.Purge(root, id)
+		audit(r, "files.purge", root.Name+":"+id, err)
+		if os.IsNotExist(err) {
+			http.Error(w, "Trash entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	case r.Method == "DELETE":
+		var purged int
+		var err error
+		for _, e := range trash.List(root) {
+			if err = trash.Purge(root, e.ID); err != nil {
+				break
+			}
+			purged++
+		}
+		audit(r, "files.purge", root.Name+": (all)", err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "purged": purged})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadZipSkipsTrash(t *testing.T) {
+	ws := setupRoots(t)
+	writeTestFile(t, filepath.Join(ws, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(ws, "gone.txt"), "deleted by someone else")
+	writeTestFile(t, filepath.Join(ws, "nested", "inner.txt"), "inner")
+	writeTestFile(t, filepath.Join(ws, "nested", "old.txt"), "deleted in a nested root")
+	portalConfig.FileRoots = append(portalConfig.FileRoots, &FileRoot{Name: "nested", Path: filepath.Join(ws, "nested"), Read: true, Write: true})
+
+	for _, spec := range []string{"workspace:gone.txt", "nested:old.txt"} {
+		p, err := resolveRootPath(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := trash.Move(p, "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleDownload(rec, httptest.NewRequest("GET", "/portal/api/download/workspace:", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if strings.Contains(f.Name, trashDirName) {
+			t.Errorf("zip contains %s", f.Name)
+		}
+	}
+	if got := strings.Join(names, ","); got != "keep.txt,nested/inner.txt" {
+		t.Errorf("zip entries = %s", got)
+	}
+}
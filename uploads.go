@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== Resumable Uploads ==============
+
+// A resumable upload is created with its target path and size, then filled
+// with chunks at increasing offsets. The data streams into a partial file
+// under data/uploads, so a dropped connection only costs the chunk in
+// flight: the client asks for the offset and carries on from there. Once the
+// last byte arrives the optional SHA-256 is verified and the file is moved
+// into place.
+//
+//	POST   /portal/api/uploads              {path, size, sha256?, overwrite?} -> {id, offset}
+//	PATCH  /portal/api/uploads/<id>         Upload-Offset: <n>, body: chunk   -> {offset, complete}
+//	GET    /portal/api/uploads/<id>         progress (also HEAD, with Upload-Offset)
+//	DELETE /portal/api/uploads/<id>         abort
+
+// Upload is a resumable upload in progress.
+type Upload struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Path      string    `json:"path"` // <root>:<rel>
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Overwrite bool      `json:"overwrite,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Offset    int64     `json:"offset"` // from the partial file, not stored
+}
+
+// UploadStore keeps the partial files and removes abandoned ones.
+type UploadStore struct {
+	mu     sync.Mutex
+	dir    string
+	expiry time.Duration   // uploads untouched this long are removed
+	busy   map[string]bool // uploads with a chunk being written
+}
+
+var uploads *UploadStore
+
+func newUploadStore(dir string, expiry time.Duration) (*UploadStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &UploadStore{dir: dir, expiry: expiry, busy: make(map[string]bool)}
+	s.Prune()
+	go func() {
+		for range time.Tick(time.Hour) {
+			s.Prune()
+		}
+	}()
+	return s, nil
+}
+
+func (s *UploadStore) partPath(id string) string { return filepath.Join(s.dir, id+".part") }
+func (s *UploadStore) metaPath(id string) string { return filepath.Join(s.dir, id+".json") }
+
+// Get returns upload id with its current offset.
+func (s *UploadStore) Get(id string) (*Upload, error) {
+	if !validToken(id) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(s.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+	u := &Upload{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.partPath(id))
+	if err != nil {
+		return nil, err
+	}
+	u.ID, u.Offset = id, info.Size()
+	return u, nil
+}
+
+// Create starts a new upload.
+func (s *UploadStore) Create(u *Upload) error {
+	u.ID = generateToken()
+	u.CreatedAt = time.Now().UTC()
+	f, err := os.OpenFile(s.partPath(u.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := writeJSONFile(s.metaPath(u.ID), u); err != nil {
+		os.Remove(s.partPath(u.ID))
+		return err
+	}
+	return nil
+}
+
+// Remove deletes upload id.
+func (s *UploadStore) Remove(id string) {
+	os.Remove(s.partPath(id))
+	os.Remove(s.metaPath(id))
+}
+
+// acquire marks id busy so that two chunks are never written at once.
+func (s *UploadStore) acquire(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *UploadStore) release(id string) {
+	s.mu.Lock()
+	delete(s.busy, id)
+	s.mu.Unlock()
+}
+
+// Write appends r to upload u, which must be at offset. It returns the new
+// offset; a short write leaves whatever arrived in place for the next try.
+func (s *UploadStore) Write(u *Upload, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.partPath(u.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, u.Size-offset))
+	return offset + n, err
+}
+
+// Prune removes uploads that have not received data within the expiry.
+func (s *UploadStore) Prune() {
+	entries, _ := os.ReadDir(s.dir)
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".part")
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < s.expiry {
+			continue
+		}
+		s.mu.Lock()
+		busy := s.busy[id]
+		s.mu.Unlock()
+		if !busy {
+			log.Printf("Removing abandoned upload %s", id)
+			s.Remove(id)
+		}
+	}
+}
+
+// finish verifies a complete upload and writes it to its target.
+func (s *UploadStore) finish(u *Upload) (*rootPath, error) {
+	if u.SHA256 != "" {
+		f, err := os.Open(s.partPath(u.ID))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != u.SHA256 {
+			// 数据损坏，只能重新上传
+			s.Remove(u.ID)
+			return nil, fmt.Errorf("checksum mismatch: got sha256 %s", sum)
+		}
+	}
+	dst, err := resolveRootPath(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	// 与文件 API 的写入相同：持有 fileWriteMu，覆盖时保留原文件的权限和属主
+	fileWriteMu.Lock()
+	defer fileWriteMu.Unlock()
+	if _, err := os.Lstat(dst.Abs); err == nil && !u.Overwrite {
+		return nil, os.ErrExist
+	}
+	if err := os.MkdirAll(filepath.Dir(dst.Abs), 0755); err != nil {
+		return nil, err
+	}
+	part, err := os.Open(s.partPath(u.ID))
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(dst.Abs, part)
+	part.Close()
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(s.partPath(u.ID))
+	os.Remove(s.metaPath(u.ID))
+	return dst, nil
+}
+
+// handleUploadsAPI implements the resumable upload protocol above.
+func handleUploadsAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := principalFrom(r).Username
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/uploads"), "/")
+
+	if id == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Path      string `json:"path"`
+			Size      int64  `json:"size"`
+			SHA256    string `json:"sha256"`
+			Overwrite bool   `json:"overwrite"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Size < 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		req.SHA256 = strings.ToLower(req.SHA256)
+		if _, err := hex.DecodeString(req.SHA256); err != nil || (req.SHA256 != "" && len(req.SHA256) != 64) {
+			http.Error(w, "Invalid sha256", http.StatusBadRequest)
+			return
+		}
+		p, ok := resolveFilePath(w, req.Path, true)
+		if !ok {
+			return
+		}
+		if p.Rel == "" {
+			http.Error(w, "Path must name a file", http.StatusBadRequest)
+			return
+		}
+		// 提前检查，避免传完才发现文件已存在
+		if _, err := os.Lstat(p.Abs); err == nil && !req.Overwrite {
+			http.Error(w, "File exists", http.StatusConflict)
+			return
+		}
+		u := &Upload{Owner: user, Path: p.Spec(), Size: req.Size, SHA256: req.SHA256, Overwrite: req.Overwrite}
+		if err := uploads.Create(u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if u.Size == 0 {
+			handleUploadChunk(w, r, u, 0)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(u)
+		return
+	}
+
+	u, err := uploads.Get(id)
+	if err != nil || u.Owner != user {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(u)
+		}
+
+	case "PATCH":
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "Upload-Offset header required", http.StatusBadRequest)
+			return
+		}
+		handleUploadChunk(w, r, u, offset)
+
+	case "DELETE":
+		if !uploads.acquire(u.ID) {
+			http.Error(w, "Upload is busy", http.StatusConflict)
+			return
+		}
+		defer uploads.release(u.ID)
+		uploads.Remove(u.ID)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleUploadChunk writes the request body at offset and finishes the upload
+// when it is complete.
+func handleUploadChunk(w http.ResponseWriter, r *http.Request, u *Upload, offset int64) {
+	if !uploads.acquire(u.ID) {
+		http.Error(w, "Another chunk is being written", http.StatusConflict)
+		return
+	}
+	defer uploads.release(u.ID)
+	// 以磁盘上的实际长度为准，客户端据此续传
+	if u, _ = uploads.Get(u.ID); u == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if offset != u.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		http.Error(w, fmt.Sprintf("Offset mismatch: upload is at %d", u.Offset), http.StatusConflict)
+		return
+	}
+	var err error
+	u.Offset, err = uploads.Write(u, offset, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if u.Offset < u.Size {
+		json.NewEncoder(w).Encode(map[string]interface{}{"offset": u.Offset, "complete": false})
+		return
+	}
+
+	dst, err := uploads.finish(u)
+	target := u.Path
+	if dst != nil {
+		target = dst.Abs
+	}
+	audit(r, "files.upload", target, err)
+	switch {
+	case errors.Is(err, os.ErrExist):
+		http.Error(w, "File exists", http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{"offset": u.Offset, "complete": true, "path": dst.Spec()})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadFinishKeepsMode(t *testing.T) {
+	ws := setupRoots(t)
+	s, err := newUploadStore(filepath.Join(t.TempDir(), "uploads"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(ws, "deploy.sh")
+	writeTestFile(t, existing, "old")
+	if err := os.Chmod(existing, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(path string) {
+		t.Helper()
+		u := &Upload{Owner: "alice", Path: path, Size: 3, Overwrite: true}
+		if err := s.Create(u); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write(u, 0, strings.NewReader("new")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.finish(u); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(s.partPath(u.ID)); !os.IsNotExist(err) {
+			t.Errorf("partial file of %s left behind", path)
+		}
+	}
+	upload("workspace:deploy.sh")
+	upload("workspace:new.txt")
+
+	for name, want := range map[string]os.FileMode{"deploy.sh": 0750, "new.txt": 0644} {
+		info, err := os.Stat(filepath.Join(ws, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s mode = %v, want %v", name, info.Mode().Perm(), want)
+		}
+		if data, _ := os.ReadFile(filepath.Join(ws, name)); string(data) != "new" {
+			t.Errorf("%s = %q, want %q", name, data, "new")
+		}
+	}
+}
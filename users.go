@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============== Users & Roles ==============
+
+type Role string
+
+const (
+	RoleReadOnly  Role = "read-only"
+	RoleDeveloper Role = "developer"
+	RoleAdmin     Role = "admin"
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleReadOnly:
+		return 1
+	case RoleDeveloper:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+func (r Role) valid() bool { return r.rank() > 0 }
+
+// allows reports whether a principal with role r may do something that needs min.
+func (r Role) allows(min Role) bool { return r.rank() >= min.rank() }
+
+// tokenUsername is the principal name used for logins with the shared PORTAL_TOKEN.
+const tokenUsername = "token"
+
+type User struct {
+	Username     string    `json:"username"`
+	Role         Role      `json:"role"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type UserStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*User
+}
+
+var users *UserStore
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+func loadUserStore(path string) (*UserStore, error) {
+	s := &UserStore{path: path, users: make(map[string]*User)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, u := range list {
+		s.users[u.Username] = u
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held.
+func (s *UserStore) save() error {
+	list := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return writeJSONFile(s.path, list)
+}
+
+func (s *UserStore) Get(username string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, false
+	}
+	copied := *u
+	return &copied, true
+}
+
+func (s *UserStore) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// Authenticate checks a username/password pair. It always does a full hash
+// comparison so that unknown usernames take as long as wrong passwords.
+func (s *UserStore) Authenticate(username, password string) (*User, bool) {
+	u, ok := s.Get(username)
+	hash := dummyPasswordHash
+	if ok {
+		hash = u.PasswordHash
+	}
+	if !verifyPassword(hash, password) || !ok {
+		return nil, false
+	}
+	return u, true
+}
+
+func (s *UserStore) Create(username, password string, role Role) (*User, error) {
+	if !usernamePattern.MatchString(username) || username == tokenUsername {
+		return nil, errors.New("invalid username")
+	}
+	if !role.valid() {
+		return nil, errors.New("invalid role")
+	}
+	if len(password) < 8 {
+		return nil, errors.New("password must be at least 8 characters")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[username]; exists {
+		return nil, errors.New("user already exists")
+	}
+	u := &User{
+		Username:     username,
+		Role:         role,
+		PasswordHash: hashPassword(password),
+		CreatedAt:    time.Now().UTC(),
+	}
+	s.users[username] = u
+	if err := s.save(); err != nil {
+		delete(s.users, username)
+		return nil, err
+	}
+	copied := *u
+	return &copied, nil
+}
+
+// Update changes the role and/or password of a user. Empty values are left untouched.
+func (s *UserStore) Update(username, password string, role Role) (*User, error) {
+	if role != "" && !role.valid() {
+		return nil, errors.New("invalid role")
+	}
+	if password != "" && len(password) < 8 {
+		return nil, errors.New("password must be at least 8 characters")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	prev := *u
+	if role != "" {
+		u.Role = role
+	}
+	if password != "" {
+		u.PasswordHash = hashPassword(password)
+	}
+	if err := s.save(); err != nil {
+		*u = prev
+		return nil, err
+	}
+	copied := *u
+	return &copied, nil
+}
+
+func (s *UserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return errors.New("user not found")
+	}
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = u
+		return err
+	}
+	return nil
+}
+
+// ============== Password Hashing ==============
+
+const passwordIterations = 100000
+
+// dummyPasswordHash is compared against when a username does not exist.
+var dummyPasswordHash = hashPassword("portal-dummy-password")
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<key>".
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, 32)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func verifyPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	var counter [4]byte
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// ============== Request Principal ==============
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Username  string
+	Role      Role
+	SessionID string   // empty for Bearer-authenticated requests
+	TokenID   string   // set when authenticated with an API token
+	Scopes    []string // nil means unrestricted
+}
+
+type principalKey struct{}
+
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+func principalFrom(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// routeGroup describes the roles and API token scopes needed to read from
+// and write to a set of routes.
+type routeGroup struct {
+	name       string
+	read       Role
+	write      Role
+	readScope  string
+	writeScope string
+}
+
+var (
+	groupFiles    = routeGroup{"files", RoleReadOnly, RoleDeveloper, ScopeFilesRead, ScopeFilesWrite}
+	groupMgmt     = routeGroup{"mgmt", RoleReadOnly, RoleAdmin, ScopeMgmtRead, ScopeMgmtUpdate}
+	groupTerminal = routeGroup{"terminal", RoleDeveloper, RoleDeveloper, ScopeTerminal, ScopeTerminal}
+	groupExec     = routeGroup{"exec", RoleDeveloper, RoleDeveloper, ScopeExec, ScopeExec}
+	groupProxy    = routeGroup{"proxy", RoleReadOnly, RoleDeveloper, ScopeProxy, ScopeProxy}
+	groupAdmin    = routeGroup{"admin", RoleAdmin, RoleAdmin, ScopeAdmin, ScopeAdmin}
+	groupAccount  = routeGroup{"account", RoleReadOnly, RoleReadOnly, ScopeAccount, ScopeAccount}
+)
+
+func isReadMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// protect wraps a handler with authentication and the role and scope checks
+// of its route group.
+func protect(g routeGroup, next http.HandlerFunc) http.HandlerFunc {
+	h := authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		need, scope := g.write, g.writeScope
+		if isReadMethod(r.Method) {
+			need, scope = g.read, g.readScope
+		}
+		p := principalFrom(r)
+		if p == nil || !p.Role.allows(need) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if p.Scopes != nil && !hasScope(p.Scopes, scope) {
+			http.Error(w, "Forbidden: token lacks scope "+scope, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 按路由组限制来源 IP，在认证之前检查
+		if !groupIPFilters[g.name].Allows(clientIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ============== User Management API ==============
+
+func handleUsersAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	username := strings.Trim(strings.TrimPrefix(r.URL.Path, "/portal/api/users"), "/")
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     Role   `json:"role"`
+	}
+
+	switch {
+	case r.Method == "GET" && username == "":
+		json.NewEncoder(w).Encode(map[string]interface{}{"users": publicUsers(users.List())})
+
+	case r.Method == "POST" && username == "":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		u, err := users.Create(req.Username, req.Password, req.Role)
+		audit(r, "users.create", req.Username+" ("+string(req.Role)+")", err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(publicUsers([]User{*u})[0])
+
+	case r.Method == "PUT" && username != "":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		u, err := users.Update(username, req.Password, req.Role)
+		audit(r, "users.update", username, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Password != "" {
+			sessions.RevokeUser(username, "")
+		}
+		json.NewEncoder(w).Encode(publicUsers([]User{*u})[0])
+
+	case r.Method == "DELETE" && username != "":
+		err := users.Delete(username)
+		audit(r, "users.delete", username, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		sessions.RevokeUser(username, "")
+		totp.Disable(username)
+		apiTokens.RevokeOwner(username)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// publicUsers strips password hashes before users are sent to clients.
+func publicUsers(list []User) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(list))
+	for _, u := range list {
+		out = append(out, map[string]interface{}{
+			"username":   u.Username,
+			"role":       u.Role,
+			"created_at": u.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return out
+}
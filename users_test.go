@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupUsers gives each role a user and returns a session cookie per role.
+func setupUsers(t *testing.T) map[Role]*http.Cookie {
+	t.Helper()
+	dir := t.TempDir()
+	oldUsers, oldSessions := users, sessions
+	t.Cleanup(func() { users, sessions = oldUsers, oldSessions })
+	var err error
+	if users, err = loadUserStore(filepath.Join(dir, "users.json")); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err = loadSessionStore(filepath.Join(dir, "sessions.json"), time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	cookies := make(map[Role]*http.Cookie)
+	for _, role := range []Role{RoleReadOnly, RoleDeveloper, RoleAdmin} {
+		name := "user-" + string(role)
+		if _, err := users.Create(name, "password-123456", role); err != nil {
+			t.Fatal(err)
+		}
+		value, _ := sessions.Create(name, role, httptest.NewRequest("GET", "/", nil))
+		cookies[role] = &http.Cookie{Name: "portal_token", Value: value}
+	}
+	return cookies
+}
+
+func TestMgmtActionsRequirePOST(t *testing.T) {
+	cookies := setupUsers(t)
+	oldBase := baseDir
+	t.Cleanup(func() { baseDir = oldBase })
+	baseDir = t.TempDir()
+	// 脚本被执行时留下标记
+	marker := filepath.Join(baseDir, "ran")
+	os.WriteFile(filepath.Join(baseDir, "update-shelley.sh"), []byte("touch "+marker+"\n"), 0755)
+
+	handlers := map[string]http.HandlerFunc{
+		"/portal/api/mgmt/update":   protect(groupMgmt, handleMgmtUpdate),
+		"/portal/api/mgmt/rollback": protect(groupMgmt, handleMgmtRollback),
+	}
+	for path, h := range handlers {
+		for _, tt := range []struct {
+			role   Role
+			method string
+			want   int
+		}{
+			{RoleReadOnly, "GET", http.StatusMethodNotAllowed},
+			{RoleReadOnly, "HEAD", http.StatusMethodNotAllowed},
+			{RoleAdmin, "GET", http.StatusMethodNotAllowed},
+			{RoleReadOnly, "POST", http.StatusForbidden},
+			{RoleDeveloper, "POST", http.StatusForbidden},
+		} {
+			req := httptest.NewRequest(tt.method, path, nil)
+			req.AddCookie(cookies[tt.role])
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s as %s: status %d, want %d", tt.method, path, tt.role, rec.Code, tt.want)
+			}
+		}
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("update script ran")
+	}
+}